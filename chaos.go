@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// flapHealth alternates the health state every interval until ctx is done.
+func flapHealth(ctx context.Context, s *ServerState, interval time.Duration) {
+	slog.Info(fmt.Sprintf("Health flapping enabled every %s", interval), "event", "flap_started", "interval", interval.String())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Health flapping stopped", "event", "flap_stopped")
+			return
+		case <-ticker.C:
+			healthy := !s.IsHealthy()
+			s.SetHealth(healthy)
+			if healthy {
+				logStateChange("/healthy", "healthy", "Automatic flip: /healthy will now return 200")
+			} else {
+				logStateChange("/healthy", "unhealthy", "Automatic flip: /healthy will now return 500")
+			}
+		}
+	}
+}
+
+// burnCPU spins one goroutine per CPU until d elapses or ctx is done.
+func burnCPU(ctx context.Context, d time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	cpus := runtime.NumCPU()
+	slog.Info(fmt.Sprintf("CPU burn started on %d cores for %s", cpus, d), "event", "burn_started", "cpus", cpus, "duration", d.String())
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	done := ctx.Done()
+	for range cpus {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	slog.Info(fmt.Sprintf("CPU burn finished after %s", time.Since(start)), "event", "burn_finished", "duration", time.Since(start).String())
+}
+
+// inflateBalloon allocates size bytes, touches every page so the memory is
+// actually resident, and stores the buffer on s, replacing any previous one.
+func inflateBalloon(s *ServerState, size int64) {
+	buf := make([]byte, size)
+	for i := 0; i < len(buf); i += os.Getpagesize() {
+		buf[i] = 1
+	}
+	s.SetBalloon(buf)
+
+	slog.Info(fmt.Sprintf("Memory balloon inflated to %d bytes", size), "event", "balloon_inflated", "bytes", size)
+}
+
+// releaseBalloon drops the held buffer and returns the memory to the OS.
+func releaseBalloon(s *ServerState) {
+	s.SetBalloon(nil)
+	debug.FreeOSMemory()
+
+	slog.Info("Memory balloon released", "event", "balloon_released")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// clock is the time source of the state logic. Production uses the real
+// clock; an offsetClock lets tests, and /debug/clock in a debugclock build,
+// move time forward instead of sleeping.
+type clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has passed on the clock
+	// and returns a func that cancels the call if it has not happened yet.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// offsetClock runs at real speed plus an offset that Advance grows. A timer
+// fires at its real deadline or as soon as Advance moves past it, whichever
+// comes first.
+type offsetClock struct {
+	mu     sync.Mutex
+	offset time.Duration
+	timers map[*clockTimer]struct{}
+}
+
+// clockTimer is an offsetClock call to f pending until at.
+type clockTimer struct {
+	at time.Time
+	f  func()
+}
+
+func (c *offsetClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return time.Now().Add(c.offset)
+}
+
+func (c *offsetClock) AfterFunc(d time.Duration, f func()) func() bool {
+	c.mu.Lock()
+	t := &clockTimer{at: time.Now().Add(c.offset + d), f: f}
+	if c.timers == nil {
+		c.timers = map[*clockTimer]struct{}{}
+	}
+	c.timers[t] = struct{}{}
+	c.mu.Unlock()
+
+	timer := time.AfterFunc(d, func() { c.fire(t) })
+	return func() bool {
+		timer.Stop()
+		return c.take(t)
+	}
+}
+
+// Advance moves the clock forward by d and fires the timers now due.
+func (c *offsetClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.offset += d
+	now := time.Now().Add(c.offset)
+	for t := range c.timers {
+		if !t.at.After(now) {
+			go c.fire(t)
+		}
+	}
+}
+
+// Offset returns how far the clock is ahead of real time.
+func (c *offsetClock) Offset() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.offset
+}
+
+// fire calls t unless it already fired or was stopped.
+func (c *offsetClock) fire(t *clockTimer) {
+	if c.take(t) {
+		t.f()
+	}
+}
+
+// take removes t from the pending timers, reporting whether it was pending.
+func (c *offsetClock) take(t *clockTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, pending := c.timers[t]
+	delete(c.timers, t)
+
+	return pending
+}
+
+// sleepClock is sleepContext measured on c, so advancing c cuts it short.
+func sleepClock(ctx context.Context, c clock, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	done := make(chan struct{})
+	stop := c.AfterFunc(d, func() { close(done) })
+	defer stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,51 @@
+//go:build debugclock
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newClock returns a virtual clock that /debug/clock can move forward.
+func newClock() clock {
+	return &offsetClock{}
+}
+
+// clockActions returns /debug/clock, which reports the virtual clock, and
+// /debug/clock/advance, which moves it forward.
+func clockActions(s *ServerState) map[string]debugAction {
+	c := s.clock.(*offsetClock)
+
+	return map[string]debugAction{
+		"clock": {
+			usage:       "/debug/clock/advance?duration=60s",
+			description: "Advance the virtual clock behind expiries, ramps and schedules; /debug/clock shows it",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/debug/clock"), "/")
+				op, value, _ := strings.Cut(rest, "/")
+				if r.URL.Query().Has("duration") {
+					value = r.URL.Query().Get("duration")
+				}
+
+				switch op {
+				case "":
+					fmt.Fprintf(w, "Clock is %s ahead of real time, now %s\n", c.Offset(), c.Now().Format(time.RFC3339))
+				case "advance":
+					d, err := time.ParseDuration(value)
+					if err != nil || d <= 0 {
+						http.Error(w, fmt.Sprintf("Invalid clock advance '%s', use ?duration=60s", value), http.StatusBadRequest)
+						return
+					}
+					c.Advance(d)
+					logStateChange("/debug/clock", "advance="+d.String(), fmt.Sprintf("Clock advanced by %s, now %s ahead of real time", d, c.Offset()))
+					fmt.Fprintf(w, "Clock advanced by %s, now %s\n", d, c.Now().Format(time.RFC3339))
+				default:
+					http.NotFound(w, r)
+				}
+			},
+		},
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !debugclock
+
+package main
+
+// newClock returns the real clock; build with -tags debugclock for one that
+// /debug/clock can move.
+func newClock() clock {
+	return realClock{}
+}
+
+// clockActions returns no actions outside a debugclock build.
+func clockActions(*ServerState) map[string]debugAction {
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestState returns a ServerState on an offsetClock the test can advance.
+func newTestState() (*ServerState, *offsetClock) {
+	c := &offsetClock{}
+	s := NewServerState()
+	s.clock = c
+
+	return s, c
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOffsetClockAdvanceFiresDueTimers(t *testing.T) {
+	c := &offsetClock{}
+	fired := make(chan struct{})
+	c.AfterFunc(time.Hour, func() { close(fired) })
+
+	c.Advance(30 * time.Minute)
+	select {
+	case <-fired:
+		t.Fatal("timer fired before its deadline")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	c.Advance(30 * time.Minute)
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("timer did not fire once the clock passed its deadline")
+	}
+
+	if got := c.Offset(); got != time.Hour {
+		t.Errorf("Offset() = %s, want 1h", got)
+	}
+}
+
+func TestOffsetClockStopCancelsTimer(t *testing.T) {
+	c := &offsetClock{}
+	fired := make(chan struct{})
+	stop := c.AfterFunc(time.Minute, func() { close(fired) })
+
+	if !stop() {
+		t.Fatal("stop() = false for a pending timer")
+	}
+	if stop() {
+		t.Error("stop() = true for an already stopped timer")
+	}
+
+	c.Advance(time.Hour)
+	select {
+	case <-fired:
+		t.Fatal("stopped timer fired")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestSetUnhealthyForExpires(t *testing.T) {
+	s, c := newTestState()
+	s.SetUnhealthyFor(time.Minute, 503)
+
+	if s.IsHealthy() {
+		t.Fatal("IsHealthy() = true right after SetUnhealthyFor")
+	}
+	if got := s.HealthCode(); got != 503 {
+		t.Fatalf("HealthCode() = %d, want 503", got)
+	}
+
+	c.Advance(time.Minute)
+	if !s.IsHealthy() {
+		t.Error("IsHealthy() = false once the unhealthy window has passed")
+	}
+	waitFor(t, "the restore timer to clear the health code", func() bool {
+		return s.HealthCode() == 200
+	})
+}
+
+func TestRampLatency(t *testing.T) {
+	s, c := newTestState()
+	s.SetLatencyRamp(10*time.Second, time.Second)
+
+	if got := s.RampLatency(); got != 0 {
+		t.Errorf("RampLatency() before startup = %s, want 0", got)
+	}
+
+	s.SetStarted(true)
+	c.Advance(5 * time.Second)
+	// Real time keeps running under the offset, so allow a little drift.
+	if got := s.RampLatency(); got < 500*time.Millisecond || got > 510*time.Millisecond {
+		t.Errorf("RampLatency() halfway = %s, want about 500ms", got)
+	}
+
+	c.Advance(10 * time.Second)
+	if got := s.RampLatency(); got != time.Second {
+		t.Errorf("RampLatency() after the ramp = %s, want 1s", got)
+	}
+}
+
+func TestScheduledFraction(t *testing.T) {
+	var schedule readySchedule
+	if err := schedule.Set("10s:0%,20s:50%,90%"); err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+
+	s, c := newTestState()
+	s.SetReadySchedule(schedule)
+
+	if got := s.ScheduledFraction(); got != 0 {
+		t.Errorf("ScheduledFraction() before startup = %g, want 0", got)
+	}
+
+	s.SetStarted(true)
+	for _, step := range []struct {
+		advance time.Duration
+		want    float64
+	}{
+		{0, 0},
+		{10 * time.Second, 0.5},
+		{10 * time.Second, 0.9},
+		{time.Hour, 0.9},
+	} {
+		c.Advance(step.advance)
+		if got := s.ScheduledFraction(); got != step.want {
+			t.Errorf("ScheduledFraction() at +%s = %g, want %g", c.Offset(), got, step.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipMinSize is the smallest body gzipResponses compresses; tiny probe
+// bodies like "HEALTHY" are sent as-is.
+const gzipMinSize = 1024
+
+// gzipResponses compresses response bodies of at least gzipMinSize bytes for
+// clients that send "Accept-Encoding: gzip".
+func gzipResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.finish()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipWriter buffers the start of a body until it knows whether the body is
+// large enough to compress, then either gzips or passes the rest through.
+type gzipWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         []byte
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	g.status = code
+	// Bodiless and already-encoded responses are never compressed.
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified || g.Header().Get("Content-Encoding") != "" {
+		g.pass()
+	}
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(p)
+	case g.passthrough:
+		return g.ResponseWriter.Write(p)
+	}
+
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.compress(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush sends what has been buffered so far, compressing it if the buffer
+// already reached gzipMinSize.
+func (g *gzipWriter) Flush() {
+	if g.gz != nil {
+		_ = g.gz.Flush()
+	} else if !g.passthrough {
+		g.pass()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// compress switches to gzip and writes the buffered bytes through it.
+func (g *gzipWriter) compress() error {
+	h := g.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	g.ResponseWriter.WriteHeader(g.status)
+
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	_, err := g.gz.Write(g.buf)
+	g.buf = nil
+
+	return err
+}
+
+// pass sends the header and buffered bytes uncompressed and stops buffering.
+func (g *gzipWriter) pass() {
+	g.passthrough = true
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) > 0 {
+		_, _ = g.ResponseWriter.Write(g.buf)
+		g.buf = nil
+	}
+}
+
+// finish flushes a short body uncompressed or closes the gzip stream. When the
+// handler wrote nothing at all, nothing is sent either, so an outer handler
+// such as requestTimeout can still choose the response.
+func (g *gzipWriter) finish() {
+	switch {
+	case g.gz != nil:
+		_ = g.gz.Close()
+	case !g.wroteHeader && len(g.buf) == 0:
+	case !g.passthrough:
+		g.pass()
+	}
+}
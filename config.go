@@ -0,0 +1,862 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+var (
+	configFlag = envFlag("config", "CONFIG_FILE", "", "YAML or JSON file of settings keyed like /debug/config; flags and env override it")
+
+	delayFlag       = envFlag("t", "START_TIME", "120s", "Startup delay duration (e.g., '30s', '2m'); SKIP_STARTUP_DELAY=true forces 0")
+	maxDelayFlag    = envFlag("max-startup-delay", "MAX_STARTUP_DELAY", "1h", "Reject startup delays longer than this as a likely typo; 0 disables the check")
+	startupFileFlag = envFlag("startup-file", "STARTUP_FILE", "", "Stay in the starting state until this file exists, instead of waiting for the startup delay")
+	deadlineFlag    = envFlag("startup-deadline", "STARTUP_DEADLINE", "0s", "Exit 1 if startup and the readiness checks have not both succeeded this long after the listeners are up; 0 disables")
+	jitterFlag      = envFlag("jitter", "JITTER", "0s", "Randomize the startup delay by up to ± this duration (e.g., '10s')")
+	portFlag        = envFlag("port", "PORT", "8080", "Port to listen on (e.g., '8080'), 0 picks a free one; use -health-addr to bind a specific host such as '[::]:8080'")
+	portFileFlag    = envFlag("port-file", "PORT_FILE", "", "Write the bound probe port to this file once listening, e.g. with -port 0")
+	networkFlag     = envFlag("network", "LISTEN_NETWORK", "tcp", "Network to listen on: 'tcp4', 'tcp6' or 'tcp' for dual-stack")
+
+	phasesFlag        = phaseVar("phases", "PHASES", "Start up in this many phases, or a comma-separated list of phase names, instead of waiting for -t")
+	phaseDurationFlag = envFlag("phase-duration", "PHASE_DURATION", "10s", "How long each -phases startup phase lasts")
+
+	healthLatencyFlag = envFlag("health-latency", "HEALTH_LATENCY", "0s", "Artificial latency added to /healthy responses (e.g., '500ms')")
+	readyLatencyFlag  = envFlag("ready-latency", "READY_LATENCY", "0s", "Artificial latency added to /ready responses (e.g., '500ms')")
+	latencyDistFlag   = envFlag("latency-dist", "LATENCY_DIST", "", "Random latency added to /healthy and /ready, sampled per request: 'normal:mean:stddev' or 'exp:mean'")
+	failRateFlag      = envFlag("fail-rate", "FAIL_RATE", "0", "Fraction (0-1) of /healthy requests that fail with 500 at random")
+
+	rampDurationFlag   = envFlag("ramp-duration", "RAMP_DURATION", "0s", "Window after startup over which /healthy latency ramps up to -ramp-max-latency")
+	rampMaxLatencyFlag = envFlag("ramp-max-latency", "RAMP_MAX_LATENCY", "0s", "Latency /healthy reaches at the end of -ramp-duration and then holds")
+	warmupFlag         = envFlag("warmup", "WARMUP", "0s", "Window after startup over which /ready goes from always failing to always succeeding")
+	readyScheduleFlag  = scheduleVar("ready-schedule", "READY_SCHEDULE", "Share of /ready requests that succeed over time since startup, e.g. '60s:0%,120s:50%,100%'; 100% after the last step")
+
+	shutdownTimeoutFlag = envFlag("shutdown-timeout", "SHUTDOWN_TIMEOUT", "5s", "Maximum time to wait for graceful shutdown (e.g., '30s')")
+	readTimeoutFlag     = envFlag("read-timeout", "READ_TIMEOUT", "10s", "Maximum duration for reading an entire request; 0 means no timeout")
+	writeTimeoutFlag    = envFlag("write-timeout", "WRITE_TIMEOUT", "10s", "Maximum duration before timing out writes of a response; 0 means no timeout")
+	requestTimeoutFlag  = envFlag("request-timeout", "REQUEST_TIMEOUT", "0s", "Maximum time a handler may take before the request fails with 503; 0 means no limit")
+	idleTimeoutFlag     = envFlag("idle-timeout", "IDLE_TIMEOUT", "60s", "Maximum time to keep idle keep-alive connections open; 0 means no timeout")
+	fastShutdownFlag    = envBool("fast-shutdown", "FAST_SHUTDOWN", false, "On SIGTERM, close all connections and exit at once instead of draining")
+	exitCodeFlag        = envFlag("exit-code", "EXIT_CODE", "0", "Process exit code after a shutdown; /debug/exit-code changes it at runtime")
+	predrainFlag        = envFlag("predrain", "PREDRAIN", "0s", "After SIGTERM, fail /ready and keep serving for this long before shutting down")
+
+	logFormatFlag    = envFlag("log-format", "LOG_FORMAT", "text", "Log output format: 'text' or 'json'")
+	logFileFlag      = envFlag("log-file", "LOG_FILE", "", "Append logs to this file, creating it if needed, instead of writing to stderr")
+	logStdoutFlag    = envBool("log-stdout", "LOG_STDOUT", false, "Write logs to stdout instead of stderr")
+	otelEndpointFlag = envFlag("otel-endpoint", "OTEL_ENDPOINT", "", "OTLP/HTTP collector URL to export trace spans to (e.g., 'http://localhost:4318'); empty disables tracing")
+	accessLogFlag    = envBool("access-log", "ACCESS_LOG", false, "Log method, path, status and duration of every request")
+	enableGzipFlag   = envBool("enable-gzip", "ENABLE_GZIP", false, "Gzip response bodies of 1KB or more for clients that accept it")
+
+	healthAddrFlag = envFlag("health-addr", "HEALTH_ADDR", "", "Address for the probe endpoints (e.g., '0.0.0.0:8080'), overrides -port")
+	debugAddrFlag  = envFlag("debug-addr", "DEBUG_ADDR", "", "Serve /debug/ on this separate address (e.g., '127.0.0.1:9090') instead of the probe server")
+	grpcPortFlag   = envFlag("grpc-port", "GRPC_PORT", "", "Serve the gRPC health protocol (grpc.health.v1.Health) on this port")
+	reflectionFlag = envBool("grpc-reflection", "GRPC_REFLECTION", false, "Register gRPC server reflection on -grpc-port so tools like grpcurl work without proto files")
+	unixSocketFlag = envFlag("unix-socket", "UNIX_SOCKET", "", "Serve on this unix domain socket path instead of TCP")
+	h2cFlag        = envBool("h2c", "H2C", false, "Also accept cleartext HTTP/2 (h2c) on the probe server; a separate -debug-addr stays HTTP/1.1")
+
+	responseHeadersFlag = headerVar("response-header", "RESPONSE_HEADER", "Header added to /healthy and /ready responses as 'Key: Value'; repeatable")
+
+	healthAllowFlag = cidrVar("health-allow-cidr", "HEALTH_ALLOW_CIDR", "Only report /healthy as healthy to clients in this CIDR, others get 503; repeatable or comma-separated")
+	trustProxyFlag  = envBool("trust-proxy", "TRUST_PROXY", false, "Use the first X-Forwarded-For address as the client IP for -health-allow-cidr")
+
+	tlsCertFlag = envFlag("tls-cert", "TLS_CERT", "", "Path to TLS certificate file; serves HTTPS when set with -tls-key")
+	tlsKeyFlag  = envFlag("tls-key", "TLS_KEY", "", "Path to TLS private key file; serves HTTPS when set with -tls-cert")
+	tlsCAFlag   = envFlag("tls-client-ca", "TLS_CLIENT_CA", "", "Path to a PEM CA bundle; requires clients to present a certificate signed by it (mTLS)")
+
+	enableDebugFlag = envBool("enable-debug", "ENABLE_DEBUG", true, "Register the /debug/ state-changing endpoints; use -enable-debug=false to disable")
+	enablePprofFlag = envBool("enable-pprof", "ENABLE_PPROF", false, "Serve net/http/pprof profiles under /debug/pprof/")
+	noRecoverFlag   = envBool("no-recover", "NO_RECOVER", false, "Crash the process on a handler panic instead of answering 500")
+
+	stateFileFlag = envFlag("state-file", "STATE_FILE", "", "JSON file used to persist health/ready/started state across restarts")
+
+	dependsOnFlag        = envFlag("depends-on", "DEPENDS_ON", "", "URL that must return 2xx for /ready to succeed")
+	readyTCPFlag         = envFlag("ready-tcp", "READY_TCP", "", "host:port that must accept a TCP connection for /ready to succeed")
+	dependsOnTimeoutFlag = envFlag("depends-on-timeout", "DEPENDS_ON_TIMEOUT", "2s", "Timeout for each -depends-on request or -ready-tcp dial")
+	dependsOnCacheFlag   = envFlag("depends-on-cache", "DEPENDS_ON_CACHE", "5s", "How long a -depends-on or -ready-tcp result is reused before re-checking")
+	checkIntervalFlag    = envFlag("check-interval", "CHECK_INTERVAL", "0s", "Run readiness checks in the background at this interval and answer /ready from the last result; 0 checks on every request")
+	readyFileFlag        = envFlag("ready-file", "READY_FILE", "", "File that must exist and be non-empty for /ready to succeed")
+	readyEnvFlag         = envFlag("ready-env", "READY_ENV", "", "NAME=value: /ready fails until environment variable NAME equals value")
+
+	debugTokenFlag = envFlag("debug-token", "DEBUG_TOKEN", "", "Require 'Authorization: Bearer <token>' on /debug/ requests; empty disables auth")
+
+	debugRateFlag = envFlag("debug-rate", "DEBUG_RATE", "0", "Maximum /debug/ requests per second (token bucket); 0 disables the limit")
+
+	maxConcurrentFlag      = envFlag("max-concurrent", "MAX_CONCURRENT", "0", "Reject requests with 503 beyond this many in flight at once; 0 disables the limit")
+	exemptHealthyLimitFlag = envBool("max-concurrent-exempt-healthy", "MAX_CONCURRENT_EXEMPT_HEALTHY", false, "Let /healthy bypass -max-concurrent so liveness still passes under saturation")
+
+	roleFlag = envFlag("role", "SERVER_ROLE", "primary", "'primary' or 'replica'; a replica fails /ready/write but passes /ready/read until /debug/promote")
+
+	readyBudgetFlag = envFlag("ready-budget", "READY_BUDGET", "0", "Fail /ready after this many successful responses; 0 disables, /debug/ready resets")
+
+	cascadeDelayFlag       = envFlag("cascade-delay", "CASCADE_DELAY", "0s", "After /ready goes not-ready, also fail /healthy once this delay passes; 0 disables")
+	unhealthyThresholdFlag = envFlag("unhealthy-threshold", "UNHEALTHY_THRESHOLD", "0", "Fail /healthy after this many consecutive /ready dependency or not-ready failures once started; 0 disables")
+	flapIntervalFlag       = envFlag("flap-interval", "FLAP_INTERVAL", "0s", "Toggle health automatically at this interval (e.g., '30s'); 0 disables")
+	heartbeatFlag          = envFlag("heartbeat", "HEARTBEAT", "0s", "Log the health and ready state at this interval (e.g., '1m'); 0 disables")
+)
+
+// headerFlag collects repeated 'Key: Value' flags into an http.Header.
+type headerFlag http.Header
+
+// headerVar defines a repeatable header flag, backed by env for a single
+// header, and returns the header it fills.
+func headerVar(name, env, usage string) http.Header {
+	header := http.Header{}
+	envVar(headerFlag(header), name, env, usage)
+
+	return header
+}
+
+func (h headerFlag) String() string {
+	var pairs []string
+	for key, values := range h {
+		for _, value := range values {
+			pairs = append(pairs, key+": "+value)
+		}
+	}
+
+	return strings.Join(pairs, ", ")
+}
+
+func (h headerFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, ":")
+	key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+	if !ok || !httpguts.ValidHeaderFieldName(key) || !httpguts.ValidHeaderFieldValue(val) {
+		return fmt.Errorf("invalid header '%s', use 'Key: Value'", value)
+	}
+	http.Header(h).Add(key, val)
+
+	return nil
+}
+
+// cidrList collects repeated or comma-separated CIDR flags.
+type cidrList []*net.IPNet
+
+// cidrVar defines a repeatable CIDR flag backed by env and returns the list
+// it fills.
+func cidrVar(name, env, usage string) *cidrList {
+	list := &cidrList{}
+	envVar(list, name, env, usage)
+
+	return list
+}
+
+func (l *cidrList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	var cidrs []string
+	for _, n := range *l {
+		cidrs = append(cidrs, n.String())
+	}
+
+	return strings.Join(cidrs, ",")
+}
+
+func (l *cidrList) Set(value string) error {
+	for cidr := range strings.SplitSeq(value, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("invalid CIDR '%s', use e.g. '10.0.0.0/8'", cidr)
+		}
+		*l = append(*l, n)
+	}
+
+	return nil
+}
+
+// MarshalJSON renders the list as CIDR strings so /debug/config can be fed
+// back through -config.
+func (l cidrList) MarshalJSON() ([]byte, error) {
+	cidrs := []string{}
+	for _, n := range l {
+		cidrs = append(cidrs, n.String())
+	}
+
+	return json.Marshal(cidrs)
+}
+
+// Contains reports whether ip falls in any of the networks.
+func (l cidrList) Contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// phaseList collects startup phase names. A number expands to that many
+// generically named phases.
+type phaseList []string
+
+// phaseVar defines a startup phases flag backed by env and returns the list
+// it fills.
+func phaseVar(name, env, usage string) *phaseList {
+	list := &phaseList{}
+	envVar(list, name, env, usage)
+
+	return list
+}
+
+func (l *phaseList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	return strings.Join(*l, ",")
+}
+
+func (l *phaseList) Set(value string) error {
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < 0 {
+			return fmt.Errorf("invalid phase count %d, use a non-negative number", n)
+		}
+		for range n {
+			*l = append(*l, fmt.Sprintf("phase-%d", len(*l)+1))
+		}
+		return nil
+	}
+
+	for name := range strings.SplitSeq(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			return fmt.Errorf("invalid phases '%s', use a count or names like 'db,cache,warm'", value)
+		}
+		*l = append(*l, name)
+	}
+
+	return nil
+}
+
+// scheduleStep makes /ready succeed for Percent of requests until Until has
+// passed since startup. A zero Until marks the final step, which holds
+// afterwards.
+type scheduleStep struct {
+	Until   time.Duration
+	Percent float64
+}
+
+// readySchedule collects 'until:percent' steps such as '60s:0%,120s:50%,100%'.
+// Past the last step /ready succeeds always unless a final bare percent
+// says otherwise.
+type readySchedule []scheduleStep
+
+// scheduleVar defines a ready schedule flag backed by env and returns the
+// schedule it fills.
+func scheduleVar(name, env, usage string) *readySchedule {
+	schedule := &readySchedule{}
+	envVar(schedule, name, env, usage)
+
+	return schedule
+}
+
+func (l *readySchedule) String() string {
+	if l == nil {
+		return ""
+	}
+
+	return strings.Join(l.steps(), ",")
+}
+
+func (l readySchedule) steps() []string {
+	steps := []string{}
+	for _, step := range l {
+		percent := strconv.FormatFloat(step.Percent, 'f', -1, 64) + "%"
+		if step.Until == 0 {
+			steps = append(steps, percent)
+		} else {
+			steps = append(steps, step.Until.String()+":"+percent)
+		}
+	}
+
+	return steps
+}
+
+func (l *readySchedule) Set(value string) error {
+	for entry := range strings.SplitSeq(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if n := len(*l); n > 0 && (*l)[n-1].Until == 0 {
+			return fmt.Errorf("invalid ready schedule step '%s', nothing may follow the final bare percent", entry)
+		}
+
+		var step scheduleStep
+		until, percent, timed := strings.Cut(entry, ":")
+		if timed {
+			d, err := time.ParseDuration(strings.TrimSpace(until))
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid ready schedule step '%s', use 'until:percent' like '60s:50%%'", entry)
+			}
+			if n := len(*l); n > 0 && d <= (*l)[n-1].Until {
+				return fmt.Errorf("invalid ready schedule step '%s', steps must be in increasing time order", entry)
+			}
+			step.Until = d
+		} else {
+			percent = until
+		}
+
+		p, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(percent), "%"), 64)
+		if err != nil || p < 0 || p > 100 {
+			return fmt.Errorf("invalid ready schedule percent in '%s', use 0-100", entry)
+		}
+		step.Percent = p
+		*l = append(*l, step)
+	}
+
+	return nil
+}
+
+// MarshalJSON renders the schedule as step strings so /debug/config can be fed
+// back through -config.
+func (l readySchedule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.steps())
+}
+
+// Fraction returns the share (0-1) of /ready requests that should succeed
+// once elapsed has passed since startup.
+func (l readySchedule) Fraction(elapsed time.Duration) float64 {
+	for _, step := range l {
+		if step.Until == 0 || elapsed < step.Until {
+			return step.Percent / 100
+		}
+	}
+
+	return 1
+}
+
+// envSetting is a string flag that falls back to an environment variable and
+// then to a default when it is not given on the command line.
+type envSetting struct {
+	flag *string
+	env  string
+	def  string
+}
+
+// envNames maps the name of every flag defined with envFlag, envBool or
+// envVar to its environment variable.
+var envNames = map[string]string{}
+
+// envApplied lists the flags defined with envBool or envVar, whose variable
+// applyEnvVars feeds through flag.Set.
+var envApplied []string
+
+// envFlag defines a flag backed by the env environment variable. The usage
+// string is extended with the variable name and default.
+func envFlag(name, env, def, usage string) envSetting {
+	envNames[name] = env
+	note := fmt.Sprintf("env %s, default '%s'", env, def)
+	if def == "" {
+		note = "env " + env
+	}
+	return envSetting{
+		flag: flag.String(name, "", fmt.Sprintf("%s (%s)", usage, note)),
+		env:  env,
+		def:  def,
+	}
+}
+
+// envBool defines a bool flag backed by the env environment variable; see
+// applyEnvVars.
+func envBool(name, env string, def bool, usage string) *bool {
+	envNames[name] = env
+	envApplied = append(envApplied, name)
+
+	return flag.Bool(name, def, fmt.Sprintf("%s (env %s)", usage, env))
+}
+
+// envVar defines a flag of a custom type backed by the env environment
+// variable; see applyEnvVars.
+func envVar(value flag.Value, name, env, usage string) {
+	envNames[name] = env
+	envApplied = append(envApplied, name)
+	flag.Var(value, name, fmt.Sprintf("%s (env %s)", usage, env))
+}
+
+// applyEnvVars sets every envBool and envVar flag not given on the command
+// line from its environment variable, if present. It runs after the config
+// file, which already leaves flags with a variable set alone, so the
+// precedence matches envFlag: flag > env > file > default.
+func applyEnvVars() {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for _, name := range envApplied {
+		value, ok := os.LookupEnv(envNames[name])
+		if !ok || explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			log.Fatalf("Invalid %s '%s': %v", envNames[name], value, err)
+		}
+	}
+}
+
+// Value resolves the setting with flag > env > default precedence.
+func (s envSetting) Value() string {
+	return lookupSetting(*s.flag, s.env, s.def)
+}
+
+// Duration is a time.Duration that encodes as a string such as "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+
+	return nil
+}
+
+// secret is a setting such as -debug-token that /debug/config must not
+// reveal. It encodes as redactedSecret, or is omitted when empty.
+type secret string
+
+// redactedSecret stands in for a secret in /debug/config. It is refused as a
+// value, so a dump loaded back fails loudly until the real secret is filled in.
+const redactedSecret = "REDACTED"
+
+func (s secret) MarshalText() ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	return []byte(redactedSecret), nil
+}
+
+// Config is the effective configuration, resolved once at startup from flags,
+// environment and defaults.
+type Config struct {
+	Port       string `json:"port,omitempty"`
+	PortFile   string `json:"port_file,omitempty"`
+	Network    string `json:"network"`
+	HealthAddr string `json:"health_addr,omitempty"`
+	ProbeAddr  string `json:"probe_addr,omitempty" flag:"-"`
+	DebugAddr  string `json:"debug_addr,omitempty"`
+	UnixSocket string `json:"unix_socket,omitempty"`
+	GRPCPort   string `json:"grpc_port,omitempty"`
+	Reflection bool   `json:"grpc_reflection" flag:"grpc-reflection"`
+	H2C        bool   `json:"h2c"`
+	TLS        bool   `json:"tls" flag:"-"`
+	TLSCert    string `json:"tls_cert,omitempty"`
+	TLSKey     string `json:"tls_key,omitempty"`
+	TLSCA      string `json:"tls_client_ca,omitempty" flag:"tls-client-ca"`
+
+	ResponseHeaders http.Header `json:"response_headers,omitempty" flag:"response-header"`
+	HealthAllow     cidrList    `json:"health_allow_cidr,omitempty" flag:"health-allow-cidr"`
+	TrustProxy      bool        `json:"trust_proxy"`
+
+	StartupDelay    Duration `json:"startup_delay" flag:"t"`
+	MaxStartupDelay Duration `json:"max_startup_delay"`
+	StartupDeadline Duration `json:"startup_deadline"`
+	Jitter          Duration `json:"jitter"`
+	StartupFile     string   `json:"startup_file,omitempty"`
+
+	Phases        phaseList `json:"phases,omitempty"`
+	PhaseDuration Duration  `json:"phase_duration"`
+
+	HealthLatency  Duration `json:"health_latency"`
+	ReadyLatency   Duration `json:"ready_latency"`
+	FailRate       float64  `json:"fail_rate"`
+	RampDuration   Duration `json:"ramp_duration"`
+	RampMaxLatency Duration `json:"ramp_max_latency"`
+	Warmup         Duration `json:"warmup"`
+
+	LatencyDist latencyDist `json:"latency_dist"`
+
+	ReadySchedule readySchedule `json:"ready_schedule,omitempty"`
+
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	Predrain        Duration `json:"predrain"`
+	FastShutdown    bool     `json:"fast_shutdown"`
+	ExitCode        int      `json:"exit_code"`
+	ReadTimeout     Duration `json:"read_timeout"`
+	WriteTimeout    Duration `json:"write_timeout"`
+	IdleTimeout     Duration `json:"idle_timeout"`
+	RequestTimeout  Duration `json:"request_timeout"`
+
+	EnableDebug        bool     `json:"enable_debug"`
+	EnablePprof        bool     `json:"enable_pprof"`
+	NoRecover          bool     `json:"no_recover"`
+	DebugRate          float64  `json:"debug_rate"`
+	DebugToken         secret   `json:"debug_token,omitempty"`
+	ReadyBudget        int64    `json:"ready_budget"`
+	UnhealthyThreshold int64    `json:"unhealthy_threshold"`
+	FlapInterval       Duration `json:"flap_interval"`
+	CascadeDelay       Duration `json:"cascade_delay"`
+	Heartbeat          Duration `json:"heartbeat"`
+
+	MaxConcurrent      int  `json:"max_concurrent"`
+	ExemptHealthyLimit bool `json:"max_concurrent_exempt_healthy"`
+
+	DependsOn        string   `json:"depends_on,omitempty"`
+	ReadyTCP         string   `json:"ready_tcp,omitempty"`
+	DependsOnTimeout Duration `json:"depends_on_timeout"`
+	DependsOnCache   Duration `json:"depends_on_cache"`
+	CheckInterval    Duration `json:"check_interval"`
+	ReadyFile        string   `json:"ready_file,omitempty"`
+	ReadyEnv         string   `json:"ready_env,omitempty"`
+	Role             string   `json:"role"`
+
+	ConfigFile   string `json:"config_file,omitempty" flag:"-"`
+	StateFile    string `json:"state_file,omitempty"`
+	LogFormat    string `json:"log_format"`
+	LogFile      string `json:"log_file,omitempty"`
+	LogStdout    bool   `json:"log_stdout"`
+	AccessLog    bool   `json:"access_log"`
+	EnableGzip   bool   `json:"enable_gzip"`
+	OtelEndpoint string `json:"otel_endpoint,omitempty"`
+}
+
+// loadConfig validates the flags and environment and resolves them into a
+// Config. It exits on the first invalid value.
+func loadConfig() *Config {
+	if unixSocketFlag.Value() != "" && (*portFlag.flag != "" || healthAddrFlag.Value() != "") {
+		log.Fatalf("-unix-socket cannot be combined with -port or -health-addr.")
+	}
+	if unixSocketFlag.Value() != "" && portFileFlag.Value() != "" {
+		log.Fatalf("-port-file cannot be combined with -unix-socket.")
+	}
+	if tlsCAFlag.Value() != "" && tlsCertFlag.Value() == "" {
+		log.Fatalf("-tls-client-ca requires -tls-cert and -tls-key.")
+	}
+	if *h2cFlag && tlsCertFlag.Value() != "" {
+		log.Fatalf("-h2c serves cleartext HTTP/2 and cannot be combined with -tls-cert; TLS already negotiates HTTP/2.")
+	}
+	if startupFileFlag.Value() != "" && len(*phasesFlag) > 0 {
+		log.Fatalf("-startup-file cannot be combined with -phases.")
+	}
+	if debugAddrFlag.Value() != "" {
+		if _, _, err := net.SplitHostPort(debugAddrFlag.Value()); err != nil {
+			log.Fatalf("Invalid debug address '%s': %v", debugAddrFlag.Value(), err)
+		}
+	}
+	if grpcPortFlag.Value() != "" {
+		validatePort("gRPC port", grpcPortFlag.Value())
+	} else if *reflectionFlag {
+		log.Fatalf("-grpc-reflection requires -grpc-port.")
+	}
+	if dependsOnFlag.Value() != "" {
+		if _, err := url.ParseRequestURI(dependsOnFlag.Value()); err != nil {
+			log.Fatalf("Invalid -depends-on URL '%s': %v", dependsOnFlag.Value(), err)
+		}
+	}
+
+	if readyTCPFlag.Value() != "" {
+		if _, _, err := net.SplitHostPort(readyTCPFlag.Value()); err != nil {
+			log.Fatalf("Invalid -ready-tcp address '%s': %v", readyTCPFlag.Value(), err)
+		}
+	}
+	if debugTokenFlag.Value() == redactedSecret {
+		log.Fatalf("-debug-token is the %s placeholder from /debug/config; set the real token.", redactedSecret)
+	}
+	if readyEnvFlag.Value() != "" {
+		if name, _, ok := strings.Cut(readyEnvFlag.Value(), "="); !ok || name == "" {
+			log.Fatalf("Invalid -ready-env '%s'. Please use NAME=value.", readyEnvFlag.Value())
+		}
+	}
+
+	// A unix socket instance has no TCP address, so none is reported that
+	// would conflict with -unix-socket when a dump is loaded back.
+	var port, probeAddr string
+	if unixSocketFlag.Value() == "" {
+		port = getPort()
+		probeAddr = getHealthAddr(port)
+	}
+	maxDelay := getDuration("max startup delay", maxDelayFlag.Value())
+
+	return &Config{
+		Port:       port,
+		PortFile:   portFileFlag.Value(),
+		Network:    getNetwork(),
+		HealthAddr: healthAddrFlag.Value(),
+		ProbeAddr:  probeAddr,
+		DebugAddr:  debugAddrFlag.Value(),
+		UnixSocket: unixSocketFlag.Value(),
+		GRPCPort:   grpcPortFlag.Value(),
+		Reflection: *reflectionFlag,
+		H2C:        *h2cFlag,
+		TLS:        getTLSEnabled(),
+		TLSCert:    tlsCertFlag.Value(),
+		TLSKey:     tlsKeyFlag.Value(),
+		TLSCA:      tlsCAFlag.Value(),
+
+		ResponseHeaders: responseHeadersFlag,
+		HealthAllow:     *healthAllowFlag,
+		TrustProxy:      *trustProxyFlag,
+
+		StartupDelay:    Duration{getStartupDelay(maxDelay)},
+		MaxStartupDelay: Duration{maxDelay},
+		StartupDeadline: Duration{getDuration("startup deadline", deadlineFlag.Value())},
+		Jitter:          Duration{getDuration("jitter", jitterFlag.Value())},
+		StartupFile:     startupFileFlag.Value(),
+
+		Phases:        *phasesFlag,
+		PhaseDuration: Duration{getDuration("phase duration", phaseDurationFlag.Value())},
+
+		HealthLatency:  Duration{getDuration("health latency", healthLatencyFlag.Value())},
+		ReadyLatency:   Duration{getDuration("ready latency", readyLatencyFlag.Value())},
+		FailRate:       getFailRate(),
+		RampDuration:   Duration{getDuration("ramp duration", rampDurationFlag.Value())},
+		RampMaxLatency: Duration{getDuration("ramp max latency", rampMaxLatencyFlag.Value())},
+		Warmup:         Duration{getDuration("warmup", warmupFlag.Value())},
+
+		LatencyDist: getLatencyDist(),
+
+		ReadySchedule: *readyScheduleFlag,
+
+		ShutdownTimeout: Duration{getShutdownTimeout()},
+		Predrain:        Duration{getDuration("predrain", predrainFlag.Value())},
+		FastShutdown:    *fastShutdownFlag,
+		ExitCode:        getExitCode(exitCodeFlag.Value()),
+		ReadTimeout:     Duration{getDuration("read timeout", readTimeoutFlag.Value())},
+		WriteTimeout:    Duration{getDuration("write timeout", writeTimeoutFlag.Value())},
+		IdleTimeout:     Duration{getDuration("idle timeout", idleTimeoutFlag.Value())},
+		RequestTimeout:  Duration{getDuration("request timeout", requestTimeoutFlag.Value())},
+
+		EnableDebug:        *enableDebugFlag,
+		EnablePprof:        *enablePprofFlag,
+		NoRecover:          *noRecoverFlag,
+		DebugRate:          getDebugRate(),
+		DebugToken:         secret(debugTokenFlag.Value()),
+		ReadyBudget:        getReadyBudget(),
+		UnhealthyThreshold: getUnhealthyThreshold(),
+		FlapInterval:       Duration{getDuration("flap interval", flapIntervalFlag.Value())},
+		CascadeDelay:       Duration{getDuration("cascade delay", cascadeDelayFlag.Value())},
+		Heartbeat:          Duration{getDuration("heartbeat", heartbeatFlag.Value())},
+
+		MaxConcurrent:      getMaxConcurrent(),
+		ExemptHealthyLimit: *exemptHealthyLimitFlag,
+
+		DependsOn:        dependsOnFlag.Value(),
+		ReadyTCP:         readyTCPFlag.Value(),
+		DependsOnTimeout: Duration{getDuration("depends-on timeout", dependsOnTimeoutFlag.Value())},
+		DependsOnCache:   Duration{getDuration("depends-on cache", dependsOnCacheFlag.Value())},
+		CheckInterval:    Duration{getDuration("check interval", checkIntervalFlag.Value())},
+		ReadyFile:        readyFileFlag.Value(),
+		ReadyEnv:         readyEnvFlag.Value(),
+		Role:             getRole(),
+
+		ConfigFile:   configFlag.Value(),
+		StateFile:    stateFileFlag.Value(),
+		LogFormat:    logFormatFlag.Value(),
+		LogFile:      logFileFlag.Value(),
+		LogStdout:    *logStdoutFlag,
+		AccessLog:    *accessLogFlag,
+		EnableGzip:   *enableGzipFlag,
+		OtelEndpoint: otelEndpointFlag.Value(),
+	}
+}
+
+// lookupSetting resolves a setting with flag > env > default precedence.
+func lookupSetting(flagValue, envName, def string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+
+	if val, ok := os.LookupEnv(envName); ok {
+		return val
+	}
+
+	return def
+}
+
+// skipStartupDelayEnv, when true, overrides -t and START_TIME with no delay
+// so CI runs start at once without editing the deployment.
+const skipStartupDelayEnv = "SKIP_STARTUP_DELAY"
+
+// getStartupDelay parses the startup delay, rejecting negative values and,
+// when maxDelay is positive, values above it.
+func getStartupDelay(maxDelay time.Duration) time.Duration {
+	delayStr := delayFlag.Value()
+
+	if value, ok := os.LookupEnv(skipStartupDelayEnv); ok {
+		skip, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Fatalf("Invalid %s '%s'. Please use 'true' or 'false'.", skipStartupDelayEnv, value)
+		}
+		if skip {
+			slog.Info(fmt.Sprintf("%s is set, skipping the startup delay of %s", skipStartupDelayEnv, delayStr),
+				"event", "startup_delay_skipped", "value", delayStr)
+			return 0
+		}
+	}
+
+	slog.Info(fmt.Sprintf("Parsing startup delay: %s", delayStr), "event", "startup_delay", "value", delayStr)
+	duration, err := time.ParseDuration(delayStr)
+	if err != nil {
+		log.Fatalf("Invalid format for startup delay '%s'. Error: %v. Please use format like '30s', '5m', '1h'.", delayStr, err)
+	}
+	if duration < 0 {
+		log.Fatalf("Invalid startup delay '%s'. The delay cannot be negative.", delayStr)
+	}
+	if maxDelay > 0 && duration > maxDelay {
+		log.Fatalf("Startup delay %s exceeds the maximum of %s. Raise -max-startup-delay (or set it to 0) if this is intended.", duration, maxDelay)
+	}
+
+	return duration
+}
+
+func getDuration(name, value string) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Fatalf("Invalid format for %s '%s'. Please use a non-negative duration like '100ms', '2s'.", name, value)
+	}
+
+	return d
+}
+
+func getShutdownTimeout() time.Duration {
+	value := shutdownTimeoutFlag.Value()
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		log.Fatalf("Invalid format for shutdown timeout '%s'. Please use a positive duration like '5s', '1m'.", value)
+	}
+
+	return timeout
+}
+
+func getTLSEnabled() bool {
+	if (tlsCertFlag.Value() == "") != (tlsKeyFlag.Value() == "") {
+		log.Fatalf("Both -tls-cert and -tls-key must be provided to enable TLS (got cert '%s', key '%s').", tlsCertFlag.Value(), tlsKeyFlag.Value())
+	}
+
+	return tlsCertFlag.Value() != ""
+}
+
+func getDebugRate() float64 {
+	value := debugRateFlag.Value()
+	debugRate, err := strconv.ParseFloat(value, 64)
+	if err != nil || debugRate < 0 {
+		log.Fatalf("Invalid debug rate '%s'. Please use a non-negative number of requests per second.", value)
+	}
+
+	return debugRate
+}
+
+func getLatencyDist() latencyDist {
+	value := latencyDistFlag.Value()
+	dist, err := parseLatencyDist(value)
+	if err != nil {
+		log.Fatalf("Invalid latency distribution '%s': %v. Please use 'normal:100ms:30ms' or 'exp:50ms'.", value, err)
+	}
+
+	return dist
+}
+
+func getFailRate() float64 {
+	value := failRateFlag.Value()
+	failRate, err := strconv.ParseFloat(value, 64)
+	if err != nil || failRate < 0 || failRate > 1 {
+		log.Fatalf("Invalid fail rate '%s'. Please use a number between 0 and 1.", value)
+	}
+
+	return failRate
+}
+
+func getReadyBudget() int64 {
+	value := readyBudgetFlag.Value()
+	budget, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || budget < 0 {
+		log.Fatalf("Invalid ready budget '%s'. Please use a non-negative number of requests.", value)
+	}
+
+	return budget
+}
+
+// Roles accepted by -role.
+const (
+	rolePrimary = "primary"
+	roleReplica = "replica"
+)
+
+func getRole() string {
+	value := roleFlag.Value()
+	if value != rolePrimary && value != roleReplica {
+		log.Fatalf("Invalid role '%s'. Please use '%s' or '%s'.", value, rolePrimary, roleReplica)
+	}
+
+	return value
+}
+
+func getExitCode(value string) int {
+	code, err := strconv.Atoi(value)
+	if err != nil || code < 0 || code > 255 {
+		log.Fatalf("Invalid exit code '%s'. Please use a number between 0 and 255.", value)
+	}
+
+	return code
+}
+
+func getNetwork() string {
+	network := networkFlag.Value()
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		log.Fatalf("Invalid network '%s'. Please use 'tcp', 'tcp4' or 'tcp6'.", network)
+	}
+
+	return network
+}
+
+func getUnhealthyThreshold() int64 {
+	value := unhealthyThresholdFlag.Value()
+	threshold, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || threshold < 0 {
+		log.Fatalf("Invalid unhealthy threshold '%s'. Please use a non-negative number of failures.", value)
+	}
+
+	return threshold
+}
+
+func getMaxConcurrent() int {
+	value := maxConcurrentFlag.Value()
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		log.Fatalf("Invalid max concurrent '%s'. Please use a non-negative number of requests.", value)
+	}
+
+	return limit
+}
+
+func getHealthAddr(port string) string {
+	if healthAddrFlag.Value() == "" {
+		return ":" + port
+	}
+
+	if _, _, err := net.SplitHostPort(healthAddrFlag.Value()); err != nil {
+		log.Fatalf("Invalid health address '%s': %v", healthAddrFlag.Value(), err)
+	}
+
+	return healthAddrFlag.Value()
+}
+
+func getPort() string {
+	portStr := portFlag.Value()
+	validatePort("port", portStr)
+
+	return portStr
+}
+
+func validatePort(name, value string) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 0 || port > 65535 {
+		log.Fatalf("Invalid %s '%s'. Please use a number between 0 and 65535, where 0 picks a free port.", name, value)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// loadConfigFile applies the settings in the YAML or JSON file at path to
+// every flag not already given on the command line or through its environment
+// variable, for flag > env > file > default precedence. Keys are the names
+// reported by /debug/config, so a dump of it can be loaded back; unknown keys
+// are an error.
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	flags := configFileFlags()
+	var unknown []string
+	for key := range settings {
+		if _, ok := flags[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return fmt.Errorf("unknown keys in %s: %s", path, strings.Join(unknown, ", "))
+	}
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for key, value := range settings {
+		name := flags[key]
+		if name == "" || explicit[name] {
+			continue
+		}
+		if env, ok := envNames[name]; ok {
+			if _, set := os.LookupEnv(env); set {
+				continue
+			}
+		}
+		for _, v := range flagValues(value) {
+			if err := flag.Set(name, v); err != nil {
+				return fmt.Errorf("%s in %s: %w", key, path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configFileFlags maps each Config key to the flag it sets: the key with
+// dashes for underscores, unless a flag struct tag names it. Fields tagged
+// flag:"-" are derived from other settings and map to "" so they are accepted
+// but ignored. Fields hidden from JSON cannot be set.
+func configFileFlags() map[string]string {
+	flags := map[string]string{}
+
+	t := reflect.TypeFor[Config]()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if key == "-" {
+			continue
+		}
+		name := field.Tag.Get("flag")
+		switch name {
+		case "-":
+			name = ""
+		case "":
+			name = strings.ReplaceAll(key, "_", "-")
+		}
+		flags[key] = name
+	}
+
+	return flags
+}
+
+// flagValues converts a file value into the strings to pass to flag.Set.
+// Lists and maps become one value per element, which suits repeatable flags
+// such as -response-header: {X-Foo: bar} sets "X-Foo: bar".
+func flagValues(value any) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []any:
+		var values []string
+		for _, item := range v {
+			values = append(values, flagValues(item)...)
+		}
+		return values
+	case map[string]any:
+		var values []string
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			for _, item := range flagValues(v[key]) {
+				values = append(values, key+": "+item)
+			}
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
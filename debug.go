@@ -0,0 +1,680 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debugAction is one /debug/<name> action. Actions only accept POST unless
+// anyMethod is set.
+type debugAction struct {
+	usage       string
+	description string
+	anyMethod   bool
+	run         func(w http.ResponseWriter, r *http.Request, param func(name string) string)
+}
+
+// maxEchoBodySize caps how much of the request body /debug/echo returns.
+const maxEchoBodySize = 1 << 20
+
+// echoResponse is the /debug/echo body.
+type echoResponse struct {
+	Method        string      `json:"method"`
+	Path          string      `json:"path"`
+	Query         string      `json:"query,omitempty"`
+	Proto         string      `json:"proto"`
+	Host          string      `json:"host"`
+	RemoteAddr    string      `json:"remote_addr"`
+	Headers       http.Header `json:"headers"`
+	ContentLength int64       `json:"content_length"`
+	Body          string      `json:"body"`
+}
+
+// debugActionInfo describes an action in the /debug/ listing.
+type debugActionInfo struct {
+	Name        string `json:"name"`
+	Usage       string `json:"usage"`
+	Description string `json:"description"`
+}
+
+// debugHandler serves the /debug/ actions, and lists them at /debug/ itself.
+// ctx bounds background work started by an action (e.g. a CPU burn) to the
+// lifetime of the server.
+func debugHandler(ctx context.Context, s *ServerState, cfg *Config) http.HandlerFunc {
+	actions := debugActions(ctx, s, cfg)
+	maps.Copy(actions, clockActions(s))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.debugHits.Add(1)
+		s.debugWindow.Add(time.Now())
+		name, arg, _ := strings.Cut(r.URL.Path[len("/debug/"):], "/")
+		query := r.URL.Query()
+		// param reads an option from the query string, falling back to the
+		// older /debug/<action>/<value> path form.
+		param := func(option string) string {
+			if query.Has(option) {
+				return query.Get(option)
+			}
+			return arg
+		}
+
+		action, ok := actions[name]
+		if name == "" {
+			action, ok = debugAction{run: func(w http.ResponseWriter, r *http.Request, _ func(string) string) {
+				var list []debugActionInfo
+				for _, key := range slices.Sorted(maps.Keys(actions)) {
+					list = append(list, debugActionInfo{Name: key, Usage: actions[key].usage, Description: actions[key].description})
+				}
+				writeJSON(w, http.StatusOK, list)
+			}}, true
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			action.run(w, r, param)
+		})
+		if !action.anyMethod {
+			h = allowMethods(h, http.MethodPost)
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// debugActions returns the /debug/ actions keyed by name.
+func debugActions(ctx context.Context, s *ServerState, cfg *Config) map[string]debugAction {
+	return map[string]debugAction{
+		"healthy": {
+			usage:       "/debug/healthy",
+			description: "Make /healthy return 200, clearing any failure, status code, fail rate, redirect or sequence",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				s.SetHealth(true)
+				logStateChange("/healthy", "healthy", "State changed: /healthy will now return 200")
+				fmt.Fprintln(w, "Health status set to HEALTHY (200 OK)")
+			},
+		},
+		"health-redirect": {
+			usage:       "/debug/health-redirect?url=https://elsewhere/healthy",
+			description: "Make /healthy return 302 to url until /debug/healthy",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("url")
+				target, err := url.Parse(value)
+				if err == nil && target.Scheme != "" && target.Host == "" {
+					// The /debug/health-redirect/<url> form is path-cleaned,
+					// which turns https://elsewhere into https:/elsewhere.
+					http.Error(w, fmt.Sprintf("Invalid redirect target '%s' has no host, pass the URL as ?url=https://elsewhere/healthy", value), http.StatusBadRequest)
+					return
+				}
+				if err != nil || (target.Host == "" && !strings.HasPrefix(target.Path, "/")) {
+					http.Error(w, fmt.Sprintf("Invalid redirect target '%s', use ?url=https://elsewhere/healthy or an absolute path", value), http.StatusBadRequest)
+					return
+				}
+				s.SetHealthRedirect(target.String())
+				logStateChange("/healthy", "redirect="+target.String(), fmt.Sprintf("State changed: /healthy will now return 302 to %s", target))
+				fmt.Fprintf(w, "Health endpoint will redirect to %s until /debug/healthy\n", target)
+			},
+		},
+		"unhealthy": {
+			usage:       "/debug/unhealthy?code=503&duration=30s",
+			description: "Make /healthy fail with code (default 500), for duration if given",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				code := 0
+				if value := r.URL.Query().Get("code"); value != "" {
+					var err error
+					if code, err = strconv.Atoi(value); err != nil || code < 400 || code > 599 {
+						http.Error(w, fmt.Sprintf("Invalid code '%s', must be an error status between 400 and 599", value), http.StatusBadRequest)
+						return
+					}
+				}
+				shown := cmp.Or(code, http.StatusInternalServerError)
+				if value := param("duration"); value != "" {
+					duration, err := time.ParseDuration(value)
+					if err != nil || duration <= 0 {
+						http.Error(w, fmt.Sprintf("Invalid duration '%s', use a positive duration like ?duration=30s", value), http.StatusBadRequest)
+						return
+					}
+					s.SetUnhealthyFor(duration, code)
+					logStateChange("/healthy", "unhealthy", fmt.Sprintf("State changed: /healthy will return %d for %s", shown, duration))
+					fmt.Fprintf(w, "Health status set to UNHEALTHY (%d %s) for %s\n", shown, http.StatusText(shown), duration)
+					return
+				}
+				if code != 0 {
+					s.SetHealthCode(code)
+				} else {
+					s.SetHealth(false)
+				}
+				logStateChange("/healthy", "unhealthy", fmt.Sprintf("State changed: /healthy will now return %d", shown))
+				fmt.Fprintf(w, "Health status set to UNHEALTHY (%d %s)\n", shown, http.StatusText(shown))
+			},
+		},
+		"health-code": {
+			usage:       "/debug/health-code?code=N",
+			description: "Make /healthy return status code N",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("code")
+				code, err := strconv.Atoi(value)
+				if err != nil || code < 100 || code > 599 {
+					http.Error(w, fmt.Sprintf("Invalid status code '%s', use ?code=N with N between 100 and 599", value), http.StatusBadRequest)
+					return
+				}
+				s.SetHealthCode(code)
+				logStateChange("/healthy", strconv.Itoa(code), fmt.Sprintf("State changed: /healthy will now return %d", code))
+				fmt.Fprintf(w, "Health status code set to %d (%s)\n", code, http.StatusText(code))
+			},
+		},
+		"health-sequence": {
+			usage:       "/debug/health-sequence?codes=200*2,500",
+			description: "Make /healthy cycle through these status codes, one per request; CODE*N repeats a code N times",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("codes")
+				codes, err := parseHealthSequence(value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Invalid health sequence '%s': %v, use ?codes=200,200,500 or ?codes=200*2,500", value, err), http.StatusBadRequest)
+					return
+				}
+				s.SetHealthSequence(codes)
+				logStateChange("/healthy", "sequence="+value, fmt.Sprintf("State changed: /healthy will now cycle through status codes %s", value))
+				fmt.Fprintf(w, "Health sequence set to %s, repeating until /debug/healthy\n", value)
+			},
+		},
+		"fail-rate": {
+			usage:       "/debug/fail-rate?rate=0.1",
+			description: "Fail this fraction of /healthy requests with 500",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("rate")
+				failRate, err := strconv.ParseFloat(value, 64)
+				if err != nil || failRate < 0 || failRate > 1 {
+					http.Error(w, fmt.Sprintf("Invalid fail rate '%s', use ?rate=R with R between 0 and 1", value), http.StatusBadRequest)
+					return
+				}
+				s.SetFailRate(failRate)
+				logStateChange("/healthy", fmt.Sprintf("fail-rate-%g", failRate), fmt.Sprintf("State changed: /healthy will now fail %g%% of requests", failRate*100))
+				fmt.Fprintf(w, "Health fail rate set to %g%%\n", failRate*100)
+			},
+		},
+		"exit-code": {
+			usage:       "/debug/exit-code?code=N",
+			description: "Exit with code N after shutdown",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("code")
+				code, err := strconv.Atoi(value)
+				if err != nil || code < 0 || code > 255 {
+					http.Error(w, fmt.Sprintf("Invalid exit code '%s', use ?code=N with N between 0 and 255", value), http.StatusBadRequest)
+					return
+				}
+				s.SetExitCode(code)
+				logStateChange("/debug/exit-code", fmt.Sprintf("exit-code=%d", code), fmt.Sprintf("State changed: process will exit with code %d after shutdown", code))
+				fmt.Fprintf(w, "Exit code set to %d\n", code)
+			},
+		},
+		"ready": {
+			usage:       "/debug/ready",
+			description: "Make /ready return 200 and reset the ready budget",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				s.SetReady(true)
+				s.readyServed.Store(0)
+				logStateChange("/ready", "ready", "State changed: /ready will now return 200")
+				fmt.Fprintln(w, "Ready status set to READY (200 OK)")
+			},
+		},
+		"noready": {
+			usage:       "/debug/noready",
+			description: "Make /ready return 500",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				s.SetReady(false)
+				logStateChange("/ready", "noready", "State changed: /ready will now return 500")
+				fmt.Fprintln(w, "Ready status set to NOREADY (500 Internal Server Error)")
+			},
+		},
+		"promote": {
+			usage:       "/debug/promote",
+			description: "Promote a -role replica to primary so /ready/write returns 200",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				if s.Role() == rolePrimary {
+					fmt.Fprintln(w, "Server is already the primary")
+					return
+				}
+				s.SetRole(rolePrimary)
+				logStateChange("/ready", rolePrimary, "State changed: promoted to primary, /ready/write will now return 200")
+				fmt.Fprintln(w, "Role set to PRIMARY (/ready/write now follows /ready)")
+			},
+		},
+		"enable": {
+			usage:       "/debug/enable?endpoint=healthy",
+			description: "Make a disabled probe endpoint respond normally again",
+			run:         setEndpointEnabled(s, true),
+		},
+		"disable": {
+			usage:       "/debug/disable?endpoint=ready",
+			description: "Make a probe endpoint ('healthy' or 'ready') return 404",
+			run:         setEndpointEnabled(s, false),
+		},
+		"health-latency": {
+			usage:       "/debug/health-latency?latency=500ms",
+			description: "Add latency to /healthy responses",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("latency")
+				latency, err := time.ParseDuration(value)
+				if err != nil || latency < 0 {
+					http.Error(w, fmt.Sprintf("Invalid latency '%s', use a non-negative duration like ?latency=500ms", value), http.StatusBadRequest)
+					return
+				}
+				s.SetHealthLatency(latency)
+				logStateChange("/healthy", "latency="+latency.String(), fmt.Sprintf("State changed: /healthy latency set to %s", latency))
+				fmt.Fprintf(w, "Health latency set to %s\n", latency)
+			},
+		},
+		"ready-latency": {
+			usage:       "/debug/ready-latency?latency=500ms",
+			description: "Add latency to /ready responses",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("latency")
+				latency, err := time.ParseDuration(value)
+				if err != nil || latency < 0 {
+					http.Error(w, fmt.Sprintf("Invalid latency '%s', use a non-negative duration like ?latency=500ms", value), http.StatusBadRequest)
+					return
+				}
+				s.SetReadyLatency(latency)
+				logStateChange("/ready", "latency="+latency.String(), fmt.Sprintf("State changed: /ready latency set to %s", latency))
+				fmt.Fprintf(w, "Ready latency set to %s\n", latency)
+			},
+		},
+		"hang": {
+			usage:       "/debug/hang?duration=10s",
+			description: "Make /healthy requests hang until duration has passed",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("duration")
+				duration, err := time.ParseDuration(value)
+				if err != nil || duration < 0 {
+					http.Error(w, fmt.Sprintf("Invalid hang duration '%s', use a non-negative duration like ?duration=10s", value), http.StatusBadRequest)
+					return
+				}
+				until := s.clock.Now().Add(duration)
+				s.SetHangUntil(until)
+				logStateChange("/healthy", "hang="+duration.String(), fmt.Sprintf("State changed: /healthy will hang until %s", until.Format(time.RFC3339)))
+				fmt.Fprintf(w, "Health endpoint will hang for %s\n", duration)
+			},
+		},
+		"delay-startup": {
+			usage:       "/debug/delay-startup?duration=60s",
+			description: "Simulate a restart: fail /startup and /ready for duration",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("duration")
+				duration, err := time.ParseDuration(value)
+				if err != nil || duration < 0 {
+					http.Error(w, fmt.Sprintf("Invalid startup delay '%s', use a non-negative duration like ?duration=60s", value), http.StatusBadRequest)
+					return
+				}
+				go runReinit(ctx, s, duration)
+				fmt.Fprintf(w, "Simulating a restart: /startup and /ready will fail for %s\n", duration)
+			},
+		},
+		"sleep": {
+			usage:       "/debug/sleep?duration=5s",
+			description: "Respond only after duration",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("duration")
+				duration, err := time.ParseDuration(value)
+				if err != nil || duration < 0 {
+					http.Error(w, fmt.Sprintf("Invalid sleep duration '%s', use a non-negative duration like ?duration=5s", value), http.StatusBadRequest)
+					return
+				}
+				// A long sleep is expected to outlast -write-timeout.
+				_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+				start := time.Now()
+				if err := sleepContext(r.Context(), duration); err != nil {
+					if !errors.Is(err, context.Canceled) {
+						return
+					}
+					slog.Info(fmt.Sprintf("Client gave up on /debug/sleep after %s of %s", time.Since(start).Round(time.Millisecond), duration),
+						"event", "sleep_cancelled", "duration", duration.String(), "elapsed", time.Since(start).String())
+					w.WriteHeader(statusClientClosedRequest)
+					return
+				}
+				fmt.Fprintf(w, "Slept for %s\n", duration)
+			},
+		},
+		"truncate": {
+			usage:       "/debug/truncate?bytes=100",
+			description: "Promise twice bytes of body, send bytes, then close the connection",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("bytes")
+				size, err := parseSize(value)
+				if err != nil || size <= 0 || size > maxBodySize {
+					http.Error(w, fmt.Sprintf("Invalid bytes '%s', use ?bytes= between 1B and %dMB", value, maxBodySize>>20), http.StatusBadRequest)
+					return
+				}
+				rc := http.NewResponseController(w)
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Header().Set("Content-Length", strconv.FormatInt(2*size, 10))
+				writePatternBody(w, size)
+				_ = rc.Flush()
+
+				conn, _, err := rc.Hijack()
+				if err != nil {
+					// HTTP/2 connections cannot be hijacked; end the stream
+					// short of Content-Length instead.
+					slog.Info(fmt.Sprintf("Could not hijack connection to truncate response: %v", err), "event", "truncate_failed")
+					panic(http.ErrAbortHandler)
+				}
+				slog.Info(fmt.Sprintf("Truncated response to %s after %d of %d bytes", r.RemoteAddr, size, 2*size),
+					"event", "response_truncated", "remote_addr", r.RemoteAddr, "bytes", size)
+				conn.Close()
+			},
+		},
+		"echo": {
+			usage:       "/debug/echo",
+			description: "Describe the request (method, path, headers, remote address, body) as JSON; accepts any method",
+			anyMethod:   true,
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				body, err := io.ReadAll(io.LimitReader(r.Body, maxEchoBodySize))
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Could not read request body: %v", err), http.StatusBadRequest)
+					return
+				}
+				writeJSON(w, http.StatusOK, echoResponse{
+					Method:        r.Method,
+					Path:          r.URL.Path,
+					Query:         r.URL.RawQuery,
+					Proto:         r.Proto,
+					Host:          r.Host,
+					RemoteAddr:    r.RemoteAddr,
+					Headers:       r.Header,
+					ContentLength: r.ContentLength,
+					Body:          string(body),
+				})
+			},
+		},
+		"stream": {
+			usage:       "/debug/stream?bytes=1MB&rate=10KBps",
+			description: "Stream a body of bytes at rate",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				size, err := parseSize(r.URL.Query().Get("bytes"))
+				if err != nil || size <= 0 {
+					http.Error(w, fmt.Sprintf("Invalid bytes '%s', use a positive size like ?bytes=1MB", r.URL.Query().Get("bytes")), http.StatusBadRequest)
+					return
+				}
+				rate, err := parseRate(r.URL.Query().Get("rate"))
+				if err != nil || rate <= 0 {
+					http.Error(w, fmt.Sprintf("Invalid rate '%s', use a positive rate like ?rate=10KBps", r.URL.Query().Get("rate")), http.StatusBadRequest)
+					return
+				}
+				// A slow stream is expected to outlast -write-timeout.
+				_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				slog.Info(fmt.Sprintf("Streaming %d bytes at %d bytes/s to %s", size, rate, r.RemoteAddr),
+					"event", "stream_started", "bytes", size, "rate", rate, "remote_addr", r.RemoteAddr)
+				start := time.Now()
+				if err := streamPatternBody(r.Context(), w, size, rate); err != nil {
+					slog.Info(fmt.Sprintf("Stream to %s stopped after %s: %v", r.RemoteAddr, time.Since(start).Round(time.Millisecond), err),
+						"event", "stream_aborted", "remote_addr", r.RemoteAddr, "elapsed", time.Since(start).String())
+				}
+			},
+		},
+		"reset": {
+			usage:       "/debug/reset",
+			description: "Restore all runtime state to its defaults",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				changed := s.Reset()
+				if len(changed) == 0 {
+					fmt.Fprintln(w, "State already at defaults, nothing to reset")
+					return
+				}
+				slog.Info(fmt.Sprintf("State reset to defaults, changed: %s", strings.Join(changed, ", ")),
+					"event", "state_reset", "changed", changed)
+				fmt.Fprintf(w, "State reset to defaults (changed: %s)\n", strings.Join(changed, ", "))
+			},
+		},
+		"stats": {
+			usage:       "/debug/stats",
+			description: "Request counts, rates and uptime as JSON",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				now := time.Now()
+				uptime := now.Sub(processStart)
+				writeJSON(w, http.StatusOK, statsResponse{
+					HealthHits:    s.healthHits.Load(),
+					ReadyHits:     s.readyHits.Load(),
+					DebugHits:     s.debugHits.Load(),
+					ReadyFailures: s.readyFailures.Load(),
+					HealthRate:    s.healthWindow.Rate(now),
+					ReadyRate:     s.readyWindow.Rate(now),
+					DebugRate:     s.debugWindow.Rate(now),
+					RateWindow:    (rateWindowSeconds * time.Second).String(),
+					StartTime:     processStart.UTC(),
+					Uptime:        uptime.Round(time.Second).String(),
+					UptimeSeconds: uptime.Seconds(),
+				})
+			},
+		},
+		"config": {
+			usage:       "/debug/config",
+			description: "Effective configuration as JSON",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				writeJSON(w, http.StatusOK, cfg)
+			},
+		},
+		"runtime": {
+			usage:       "/debug/runtime",
+			description: "Memory and goroutine statistics as JSON",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				var mem runtime.MemStats
+				runtime.ReadMemStats(&mem)
+				writeJSON(w, http.StatusOK, runtimeResponse{
+					Alloc:        mem.Alloc,
+					TotalAlloc:   mem.TotalAlloc,
+					Sys:          mem.Sys,
+					HeapInuse:    mem.HeapInuse,
+					NumGC:        mem.NumGC,
+					NumGoroutine: runtime.NumGoroutine(),
+					NumCPU:       runtime.NumCPU(),
+					GOMAXPROCS:   runtime.GOMAXPROCS(0),
+				})
+			},
+		},
+		"goroutines": {
+			usage:       "/debug/goroutines or /debug/goroutines?format=dump",
+			description: "Current goroutine count as JSON, or every goroutine's stack with format=dump",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				if param("format") != "dump" {
+					writeJSON(w, http.StatusOK, map[string]int{"goroutines": runtime.NumGoroutine()})
+					return
+				}
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Write(goroutineStacks())
+			},
+		},
+		"crash": {
+			usage:       "/debug/crash",
+			description: "Exit immediately with code 1",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				fmt.Fprintln(w, "Crashing with exit code 1")
+				_ = http.NewResponseController(w).Flush()
+				slog.Error("Crash requested via /debug/crash, exiting with code 1", "event", "crash")
+				os.Exit(1)
+			},
+		},
+		"panic": {
+			usage:       "/debug/panic or /debug/panic?in=handler",
+			description: "Crash the process with an unrecovered panic; in=handler panics inside the handler instead, which answers 500 unless -no-recover",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				if r.URL.Query().Get("in") == "handler" {
+					slog.Error("Handler panic requested via /debug/panic", "event", "panic", "in", "handler")
+					panic("panic requested via /debug/panic")
+				}
+
+				fmt.Fprintln(w, "Crashing with an unrecovered panic")
+				_ = http.NewResponseController(w).Flush()
+				slog.Error("Panic requested via /debug/panic, crashing", "event", "panic")
+				// net/http recovers handler panics, so panic on a goroutine of
+				// our own for a real unclean exit.
+				go panic("panic requested via /debug/panic")
+				select {}
+			},
+		},
+		"latency-profile": {
+			usage:       "/debug/latency-profile with JSON body [{\"at\":\"0s\",\"latency\":\"10ms\"},...]",
+			description: "Load a /healthy latency timeline; an empty body clears it",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				var steps []latencyStep
+				if err := json.NewDecoder(io.LimitReader(r.Body, maxLatencyProfileSize)).Decode(&steps); err != nil && !errors.Is(err, io.EOF) {
+					http.Error(w, fmt.Sprintf("Invalid latency profile: %v, use a JSON body like [{\"at\":\"0s\",\"latency\":\"10ms\"},{\"at\":\"30s\",\"latency\":\"200ms\"}]", err), http.StatusBadRequest)
+					return
+				}
+				for i, step := range steps {
+					if step.At.Duration < 0 || step.Latency.Duration < 0 || (i > 0 && step.At.Duration < steps[i-1].At.Duration) {
+						http.Error(w, fmt.Sprintf("Invalid latency profile step %d, use non-negative durations sorted by 'at'", i), http.StatusBadRequest)
+						return
+					}
+				}
+				s.SetLatencyProfile(steps)
+				if len(steps) == 0 {
+					logStateChange("/healthy", "latency_profile=none", "State changed: /healthy latency profile cleared")
+					fmt.Fprintln(w, "Health latency profile cleared")
+					return
+				}
+				logStateChange("/healthy", fmt.Sprintf("latency_profile=%d", len(steps)), fmt.Sprintf("State changed: /healthy latency profile loaded with %d steps over %s", len(steps), steps[len(steps)-1].At))
+				fmt.Fprintf(w, "Health latency profile loaded with %d steps\n", len(steps))
+			},
+		},
+		"body": {
+			usage:       "/debug/body?size=1MB or ?size=reset",
+			description: "Pad /healthy responses to size bytes",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("size")
+				if value == "reset" {
+					s.SetBodySize(0)
+					logStateChange("/healthy", "body=default", "State changed: /healthy body restored to default")
+					fmt.Fprintln(w, "Health body restored to default")
+					return
+				}
+				size, err := parseSize(value)
+				if err != nil || size <= 0 || size > maxBodySize {
+					http.Error(w, fmt.Sprintf("Invalid body size '%s', use ?size= between 1B and %dMB or 'reset'", value, maxBodySize>>20), http.StatusBadRequest)
+					return
+				}
+				s.SetBodySize(size)
+				logStateChange("/healthy", fmt.Sprintf("body=%d", size), fmt.Sprintf("State changed: /healthy body set to %d bytes", size))
+				fmt.Fprintf(w, "Health body size set to %d bytes\n", size)
+			},
+		},
+		"burn": {
+			usage:       "/debug/burn?duration=30s",
+			description: "Burn all CPUs for duration",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("duration")
+				duration, err := time.ParseDuration(value)
+				if err != nil || duration <= 0 {
+					http.Error(w, fmt.Sprintf("Invalid burn duration '%s', use a positive duration like ?duration=30s", value), http.StatusBadRequest)
+					return
+				}
+				if !s.StartBurn() {
+					http.Error(w, "CPU burn already in progress", http.StatusConflict)
+					return
+				}
+				go func() {
+					defer s.StopBurn()
+					burnCPU(ctx, duration)
+				}()
+				fmt.Fprintf(w, "Burning all CPUs for %s\n", duration)
+			},
+		},
+		"balloon": {
+			usage:       "/debug/balloon?size=256MB or ?size=release",
+			description: "Hold or release a memory balloon of size bytes",
+			run: func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+				value := param("size")
+				if value == "release" {
+					released := s.BalloonSize()
+					releaseBalloon(s)
+					fmt.Fprintf(w, "Released memory balloon of %d bytes\n", released)
+					return
+				}
+				size, err := parseSize(value)
+				if err != nil || size <= 0 {
+					http.Error(w, fmt.Sprintf("Invalid balloon size '%s', use e.g. ?size=256MB or 'release'", value), http.StatusBadRequest)
+					return
+				}
+				inflateBalloon(s, size)
+				fmt.Fprintf(w, "Holding memory balloon of %d bytes\n", size)
+			},
+		},
+	}
+}
+
+// maxHealthSequence caps the expanded length of a /debug/health-sequence.
+const maxHealthSequence = 10000
+
+// parseHealthSequence expands a comma-separated list of status codes, where
+// CODE*N stands for N repetitions of CODE.
+func parseHealthSequence(value string) ([]int, error) {
+	var codes []int
+	for entry := range strings.SplitSeq(value, ",") {
+		codeText, weightText, weighted := strings.Cut(strings.TrimSpace(entry), "*")
+		code, err := strconv.Atoi(codeText)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("status code '%s' is not between 100 and 599", codeText)
+		}
+		weight := 1
+		if weighted {
+			weight, err = strconv.Atoi(weightText)
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("weight '%s' is not a positive number", weightText)
+			}
+		}
+		if len(codes)+weight > maxHealthSequence {
+			return nil, fmt.Errorf("more than %d codes", maxHealthSequence)
+		}
+		codes = append(codes, slices.Repeat([]int{code}, weight)...)
+	}
+
+	return codes, nil
+}
+
+// setEndpointEnabled returns the run func of the enable and disable actions.
+func setEndpointEnabled(s *ServerState, enabled bool) func(http.ResponseWriter, *http.Request, func(string) string) {
+	return func(w http.ResponseWriter, r *http.Request, param func(string) string) {
+		value := param("endpoint")
+		if value != "healthy" && value != "ready" {
+			http.Error(w, fmt.Sprintf("Invalid endpoint '%s', use 'healthy' or 'ready'", value), http.StatusBadRequest)
+			return
+		}
+		endpoint := "/" + value
+		s.SetEndpointEnabled(endpoint, enabled)
+		if enabled {
+			logStateChange(endpoint, "enabled", fmt.Sprintf("State changed: %s will now respond normally", endpoint))
+			fmt.Fprintf(w, "Endpoint %s enabled\n", endpoint)
+			return
+		}
+		logStateChange(endpoint, "disabled", fmt.Sprintf("State changed: %s will now return 404", endpoint))
+		fmt.Fprintf(w, "Endpoint %s disabled (404 Not Found)\n", endpoint)
+	}
+}
+
+// goroutineStacks returns the stack traces of all goroutines, growing the
+// buffer until runtime.Stack fits.
+func goroutineStacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// checker is a readiness dependency consulted by readyHandler.
+type checker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+// checkStatus is the outcome of one check in the /ready JSON breakdown.
+type checkStatus struct {
+	Name           string  `json:"name"`
+	Status         string  `json:"status"`
+	Error          string  `json:"error,omitempty"`
+	Latency        string  `json:"latency"`
+	LatencySeconds float64 `json:"latency_seconds"`
+}
+
+// runChecks runs every check rather than stopping at the first failure, and
+// returns the per-check results along with the first error.
+func runChecks(ctx context.Context, checks []checker) ([]checkStatus, error) {
+	results := make([]checkStatus, 0, len(checks))
+	var firstErr error
+	for _, c := range checks {
+		start := time.Now()
+		err := c.Check(ctx)
+		took := time.Since(start)
+
+		res := checkStatus{Name: c.Name(), Status: "ok", Latency: took.String(), LatencySeconds: took.Seconds()}
+		if err != nil {
+			res.Status, res.Error = "failed", err.Error()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", c.Name(), err)
+			}
+		}
+		results = append(results, res)
+	}
+
+	return results, firstErr
+}
+
+// pollChecks runs checks every interval until ctx is done, storing each round
+// on s so /ready can answer from the last result without waiting on them.
+func pollChecks(ctx context.Context, s *ServerState, checks []checker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		results, err := runChecks(ctx, checks)
+		s.SetCheckResults(results, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cachedCheck reuses the result of the wrapped checker for cacheFor so
+// frequent probes don't hammer the target.
+type cachedCheck struct {
+	checker  checker
+	cacheFor time.Duration
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	lastErr   error
+}
+
+func (c *cachedCheck) Name() string {
+	return c.checker.Name()
+}
+
+func (c *cachedCheck) Check(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < c.cacheFor {
+		return c.lastErr
+	}
+
+	c.lastErr = c.checker.Check(ctx)
+	c.checkedAt = time.Now()
+
+	return c.lastErr
+}
+
+// httpCheck reports whether a downstream URL answers with a 2xx status.
+type httpCheck struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPCheck(url string, timeout, cacheFor time.Duration) checker {
+	return &cachedCheck{
+		checker:  httpCheck{url: url, client: &http.Client{Timeout: timeout}},
+		cacheFor: cacheFor,
+	}
+}
+
+func (c httpCheck) Name() string {
+	return "http " + c.url
+}
+
+func (c httpCheck) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", c.url, resp.Status)
+	}
+
+	return nil
+}
+
+// tcpCheck reports whether a TCP connection to addr can be opened, for
+// dependencies that don't speak HTTP such as a database port.
+type tcpCheck struct {
+	addr   string
+	dialer *net.Dialer
+}
+
+func newTCPCheck(addr string, timeout, cacheFor time.Duration) checker {
+	return &cachedCheck{
+		checker:  tcpCheck{addr: addr, dialer: &net.Dialer{Timeout: timeout}},
+		cacheFor: cacheFor,
+	}
+}
+
+func (c tcpCheck) Name() string {
+	return "tcp " + c.addr
+}
+
+func (c tcpCheck) Check(ctx context.Context) error {
+	conn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// fileCheck passes once path exists and is non-empty, letting an init step
+// signal readiness by writing a file.
+type fileCheck struct {
+	path string
+}
+
+func (c fileCheck) Name() string {
+	return "file " + c.path
+}
+
+func (c fileCheck) Check(context.Context) error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty", c.path)
+	}
+
+	return nil
+}
+
+// envCheck passes once the environment variable name equals value. It is
+// re-read on every probe so a late-injected value is picked up.
+type envCheck struct {
+	name  string
+	value string
+}
+
+func (c envCheck) Name() string {
+	return "env " + c.name
+}
+
+func (c envCheck) Check(context.Context) error {
+	got, ok := os.LookupEnv(c.name)
+	if !ok {
+		return fmt.Errorf("%s is not set", c.name)
+	}
+	if got != c.value {
+		return fmt.Errorf("%s is '%s', waiting for '%s'", c.name, got, c.value)
+	}
+
+	return nil
+}
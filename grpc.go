@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// grpcWatchInterval is how often Watch re-reads the health state.
+const grpcWatchInterval = 500 * time.Millisecond
+
+// grpcHealthService implements grpc.health.v1.Health on top of ServerState,
+// so the /debug/ toggles drive the gRPC and HTTP views alike. Both the
+// overall ("") and "slow" service names are recognised.
+type grpcHealthService struct {
+	healthpb.UnimplementedHealthServer
+
+	ctx   context.Context
+	state *ServerState
+}
+
+func (h *grpcHealthService) servingStatus(service string) (healthpb.HealthCheckResponse_ServingStatus, bool) {
+	if service != "" && service != "slow" {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, false
+	}
+	if h.state.IsHealthy() {
+		return healthpb.HealthCheckResponse_SERVING, true
+	}
+
+	return healthpb.HealthCheckResponse_NOT_SERVING, true
+}
+
+func (h *grpcHealthService) Check(_ context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	st, ok := h.servingStatus(req.GetService())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+
+	return &healthpb.HealthCheckResponse{Status: st}, nil
+}
+
+// Watch sends the current status and then every change until the client goes
+// away or the server starts shutting down.
+func (h *grpcHealthService) Watch(req *healthpb.HealthCheckRequest, stream grpc.ServerStreamingServer[healthpb.HealthCheckResponse]) error {
+	ticker := time.NewTicker(grpcWatchInterval)
+	defer ticker.Stop()
+
+	last := healthpb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		if st, _ := h.servingStatus(req.GetService()); st != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: st}); err != nil {
+				return err
+			}
+			last = st
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-h.ctx.Done():
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
+
+// newGRPCServer returns a server with the health service registered, and
+// with server reflection too when reflect is set.
+func newGRPCServer(ctx context.Context, s *ServerState, reflect bool) *grpc.Server {
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, &grpcHealthService{ctx: ctx, state: s})
+	if reflect {
+		reflection.Register(server)
+		slog.Info("gRPC reflection enabled", "event", "grpc_reflection_enabled")
+	}
+
+	return server
+}
+
+// stopGRPCServer stops server gracefully, falling back to a hard stop if ctx
+// expires first.
+func stopGRPCServer(ctx context.Context, server *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		slog.Error("gRPC server did not stop in time, forced stop", "event", "grpc_forced_stop")
+		return fmt.Errorf("grpc server: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// heartbeat logs the startup, health, readiness and in-flight request count every
+// interval until ctx is done, giving a timeline even without probe traffic.
+func heartbeat(ctx context.Context, s *ServerState, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			started, healthy, ready, inFlight := s.IsStarted(), s.IsHealthy(), s.IsReady(), s.inFlight.Load()
+			slog.Info(fmt.Sprintf("Heartbeat: started: %t, healthy: %t, ready: %t, in flight: %d", started, healthy, ready, inFlight),
+				"event", "heartbeat", "started", started, "healthy", healthy, "ready", ready, "in_flight", inFlight)
+		}
+	}
+}
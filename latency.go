@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// latencyDist is a random latency distribution parsed from -latency-dist,
+// either "normal:mean:stddev" or "exp:mean". The zero value adds no latency.
+type latencyDist struct {
+	kind   string
+	mean   time.Duration
+	stddev time.Duration
+}
+
+// parseLatencyDist parses a -latency-dist spec; an empty spec disables it.
+func parseLatencyDist(spec string) (latencyDist, error) {
+	if spec == "" {
+		return latencyDist{}, nil
+	}
+
+	parts := strings.Split(spec, ":")
+	durations := make([]time.Duration, len(parts)-1)
+	for i, part := range parts[1:] {
+		d, err := time.ParseDuration(part)
+		if err != nil || d < 0 {
+			return latencyDist{}, fmt.Errorf("invalid duration '%s'", part)
+		}
+		durations[i] = d
+	}
+
+	switch {
+	case parts[0] == "normal" && len(durations) == 2:
+		return latencyDist{kind: "normal", mean: durations[0], stddev: durations[1]}, nil
+	case parts[0] == "exp" && len(durations) == 1:
+		return latencyDist{kind: "exp", mean: durations[0]}, nil
+	default:
+		return latencyDist{}, fmt.Errorf("unknown distribution '%s'", spec)
+	}
+}
+
+// Sample draws one latency from the distribution. Normal samples below zero
+// are clamped to zero.
+func (d latencyDist) Sample() time.Duration {
+	switch d.kind {
+	case "normal":
+		return max(0, d.mean+time.Duration(rand.NormFloat64()*float64(d.stddev)))
+	case "exp":
+		return time.Duration(rand.ExpFloat64() * float64(d.mean))
+	default:
+		return 0
+	}
+}
+
+func (d latencyDist) String() string {
+	switch d.kind {
+	case "normal":
+		return fmt.Sprintf("normal:%s:%s", d.mean, d.stddev)
+	case "exp":
+		return fmt.Sprintf("exp:%s", d.mean)
+	default:
+		return ""
+	}
+}
+
+// MarshalText renders the spec, e.g. "normal:100ms:30ms", so /debug/config
+// can be fed back through -config.
+func (d latencyDist) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
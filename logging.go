@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+)
+
+// plainHandler is a slog.Handler that drops attributes and prints only the
+// message through its own logger, preserving the original text log format.
+type plainHandler struct {
+	logger *log.Logger
+}
+
+func (h plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h plainHandler) Handle(_ context.Context, r slog.Record) error {
+	return h.logger.Output(0, r.Message)
+}
+
+func (h plainHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h plainHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// setupLogging installs the default slog logger for the given format. The
+// standard log package is redirected to it as well, so log.Fatalf output
+// follows the same format.
+func setupLogging(format string, w io.Writer) {
+	var handler slog.Handler
+
+	switch format {
+	case "text":
+		handler = plainHandler{logger: log.New(w, "", log.LstdFlags)}
+	case "json":
+		handler = slog.NewJSONHandler(w, nil)
+	default:
+		log.Fatalf("Invalid log format '%s'. Please use 'text' or 'json'.", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+}
+
+// logOutput opens the log destination: the file at path in append mode when
+// set, otherwise stdout or stderr.
+func logOutput(path string, stdout bool) io.Writer {
+	if path != "" && stdout {
+		log.Fatalf("-log-file and -log-stdout cannot be combined.")
+	}
+	if stdout {
+		return os.Stdout
+	}
+	if path == "" {
+		return os.Stderr
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Fatalf("Could not open log file '%s': %v", path, err)
+	}
+
+	return f
+}
+
+// logStateChange records a debug-triggered state transition.
+func logStateChange(endpoint, newState, msg string) {
+	slog.Info(msg, "event", "state_change", "endpoint", endpoint, "new_state", newState)
+}
+
+// logStateSnapshot records the full server state, e.g. on SIGUSR1. The text
+// format drops attributes, so there the state is embedded in the message as
+// JSON instead.
+func logStateSnapshot(snap stateSnapshot) {
+	msg := "State snapshot"
+	if _, plain := slog.Default().Handler().(plainHandler); plain {
+		data, err := json.Marshal(snap)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Could not encode state snapshot: %v", err), "event", "state_snapshot_failed")
+			return
+		}
+		msg = fmt.Sprintf("State snapshot: %s", data)
+	}
+	slog.Info(msg, "event", "state_snapshot", "state", snap)
+}
@@ -2,122 +2,1367 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
 )
 
-type ServerState struct {
-	mu        sync.RWMutex
-	isHealthy bool
-	isReady   bool
+type ServerState struct {
+	mu sync.RWMutex
+	// clock is the time source for expiries, ramps and schedules. It is set
+	// once by NewServerState and never changes.
+	clock clock
+
+	isHealthy  bool
+	isReady    bool
+	isStarted  bool
+	isDraining bool
+	healthCode int
+
+	unhealthyUntil time.Time
+	failRate       float64
+	healthRedirect string
+
+	// healthSequence holds status codes /healthy cycles through, one per
+	// request; sequenceNext indexes the next one.
+	healthSequence []int
+	sequenceNext   int
+
+	cascadeDelay time.Duration
+	cascadeAt    time.Time
+
+	startupDelay  time.Duration
+	startingUntil time.Time
+	startedAt     time.Time
+	phases        []string
+	phase         int
+	healthLatency time.Duration
+	readyLatency  time.Duration
+	latencyDist   latencyDist
+	hangUntil     time.Time
+	rampDuration  time.Duration
+	rampMax       time.Duration
+	warmup        time.Duration
+	schedule      readySchedule
+	role          string
+
+	// latencyProfile is a /healthy latency timeline measured from
+	// profileLoaded; see ProfileLatency.
+	latencyProfile []latencyStep
+	profileLoaded  time.Time
+
+	bodySize int64
+
+	// disabled holds probe endpoints, e.g. "/ready", that should answer 404
+	// as if the route did not exist.
+	disabled map[string]bool
+
+	isBurning bool
+	balloon   []byte
+
+	exitCode int
+
+	stateFile string
+
+	// checkResults is the last background readiness check round, taken at
+	// checkedAt; see pollChecks.
+	checkResults []checkStatus
+	checkErr     error
+	checkedAt    time.Time
+
+	// listenAddr is the address the probe listener is bound to, which
+	// differs from the configured one when the port is 0.
+	listenAddr string
+
+	readyBudget int64
+	readyServed atomic.Int64
+
+	unhealthyThreshold int64
+	readyFailures      atomic.Int64
+
+	healthHits atomic.Int64
+	readyHits  atomic.Int64
+	debugHits  atomic.Int64
+
+	healthWindow rateWindow
+	readyWindow  rateWindow
+	debugWindow  rateWindow
+
+	inFlight atomic.Int64
+}
+
+func (s *ServerState) SetHealth(status bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.isHealthy = status
+	s.healthCode = 0
+	s.unhealthyUntil = time.Time{}
+	s.failRate = 0
+	s.healthRedirect = ""
+	s.healthSequence = nil
+	s.persistLocked()
+}
+
+func (s *ServerState) IsHealthy() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.healthyLocked()
+}
+
+// healthyLocked reports health, treating an expired temporary unhealthy
+// state as healthy even before the restore timer has fired.
+func (s *ServerState) healthyLocked() bool {
+	if !s.isHealthy && !s.unhealthyUntil.IsZero() && !s.clock.Now().Before(s.unhealthyUntil) {
+		return true
+	}
+
+	return s.isHealthy
+}
+
+// SetUnhealthyFor makes the server unhealthy for d, responding with code
+// (or 500 when code is zero), after which a timer
+// restores health unless the state has been changed again in the meantime.
+func (s *ServerState) SetUnhealthyFor(d time.Duration, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until := s.clock.Now().Add(d)
+	s.isHealthy = false
+	s.healthCode = code
+	s.unhealthyUntil = until
+	s.healthRedirect = ""
+	s.healthSequence = nil
+	s.persistLocked()
+
+	s.clock.AfterFunc(d, func() {
+		if s.restoreHealth(until) {
+			logStateChange("/healthy", "healthy", "Temporary unhealthy state expired: /healthy will now return 200")
+		}
+	})
+}
+
+// restoreHealth ends the temporary unhealthy state that was set to expire at
+// until. It returns false if that state has since been replaced.
+func (s *ServerState) restoreHealth(until time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.unhealthyUntil.Equal(until) {
+		return false
+	}
+	s.isHealthy = true
+	s.healthCode = 0
+	s.unhealthyUntil = time.Time{}
+	s.persistLocked()
+
+	return true
+}
+
+// SetHealthCode makes /healthy respond with code. Codes below 400 count as
+// healthy so IsHealthy stays meaningful for metrics and logs.
+func (s *ServerState) SetHealthCode(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.isHealthy = code < http.StatusBadRequest
+	s.healthCode = code
+	s.unhealthyUntil = time.Time{}
+	s.healthRedirect = ""
+	s.healthSequence = nil
+	s.persistLocked()
+}
+
+// HealthCode returns the status code /healthy should respond with, falling
+// back to 200/500 when no custom code has been set.
+func (s *ServerState) HealthCode() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.healthCode != 0 {
+		return s.healthCode
+	}
+	if s.healthyLocked() {
+		return http.StatusOK
+	}
+
+	return http.StatusInternalServerError
+}
+
+// SetReady sets the manual ready state. With a cascade delay configured,
+// going not-ready also schedules /healthy to fail once that delay passes,
+// unless the server becomes ready again first. Going ready also restarts the
+// consecutive /ready failure count.
+func (s *ServerState) SetReady(status bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wasReady := s.isReady
+	s.isReady = status
+	s.persistLocked()
+
+	if status {
+		s.cascadeAt = time.Time{}
+		s.readyFailures.Store(0)
+		return
+	}
+	if !wasReady || s.cascadeDelay <= 0 {
+		return
+	}
+
+	at := s.clock.Now().Add(s.cascadeDelay)
+	s.cascadeAt = at
+	s.clock.AfterFunc(s.cascadeDelay, func() {
+		if s.cascadeHealth(at) {
+			logStateChange("/healthy", "unhealthy", fmt.Sprintf("Cascade: /ready has failed for %s, /healthy will now return 500", s.CascadeDelay()))
+		}
+	})
+}
+
+// cascadeHealth makes the server unhealthy for the cascade scheduled at at.
+// It returns false if that cascade was cancelled or replaced.
+func (s *ServerState) cascadeHealth(at time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.cascadeAt.Equal(at) || s.isReady {
+		return false
+	}
+	s.cascadeAt = time.Time{}
+	s.isHealthy = false
+	s.healthCode = 0
+	s.unhealthyUntil = time.Time{}
+	s.persistLocked()
+
+	return true
+}
+
+// SetCascadeDelay makes every later ready-to-not-ready transition fail
+// /healthy after d; zero disables the cascade.
+func (s *ServerState) SetCascadeDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cascadeDelay = d
+}
+
+func (s *ServerState) CascadeDelay() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.cascadeDelay
+}
+
+func (s *ServerState) IsReady() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.isReady
+}
+
+func (s *ServerState) SetStarted(status bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status && !s.isStarted {
+		s.startedAt = s.clock.Now()
+	}
+	s.isStarted = status
+	s.persistLocked()
+}
+
+func (s *ServerState) IsStarted() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.isStarted
+}
+
+// SetDraining marks the server as shutting down so /ready fails while the
+// listeners are still open. It is deliberately not persisted.
+func (s *ServerState) SetDraining(status bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.isDraining = status
+}
+
+func (s *ServerState) IsDraining() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.isDraining
+}
+
+// SetStartupDelay records the configured (un-jittered) startup delay.
+func (s *ServerState) SetStartupDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.startupDelay = d
+}
+
+func (s *ServerState) StartupDelay() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.startupDelay
+}
+
+// SetStartingUntil records when the in-progress startup delay will elapse.
+func (s *ServerState) SetStartingUntil(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.startingUntil = t
+}
+
+// SetCheckResults stores a round of background readiness checks.
+func (s *ServerState) SetCheckResults(results []checkStatus, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkResults = results
+	s.checkErr = err
+	s.checkedAt = s.clock.Now()
+}
+
+// CheckResults returns the last background check round and when it ran. It
+// reports an error until the first round has completed.
+func (s *ServerState) CheckResults() ([]checkStatus, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.checkedAt.IsZero() {
+		return nil, s.checkedAt, errors.New("readiness checks have not completed yet")
+	}
+
+	return s.checkResults, s.checkedAt, s.checkErr
+}
+
+func (s *ServerState) SetListenAddr(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listenAddr = addr
+}
+
+func (s *ServerState) ListenAddr() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.listenAddr
+}
+
+// SetPhase records that startup is in phase index of phases.
+func (s *ServerState) SetPhase(phases []string, index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.phases = phases
+	s.phase = index
+}
+
+// Phase returns the 1-based index and name of the current startup phase and
+// the number of phases, or zeros when startup is not phased or has finished.
+func (s *ServerState) Phase() (index int, name string, total int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.isStarted || s.phase >= len(s.phases) {
+		return 0, "", 0
+	}
+
+	return s.phase + 1, s.phases[s.phase], len(s.phases)
+}
+
+// SetExitCode sets the status the process exits with after shutdown.
+func (s *ServerState) SetExitCode(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.exitCode = code
+}
+
+func (s *ServerState) ExitCode() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.exitCode
+}
+
+// BeginReinit puts the server back into the starting, not-ready state until
+// until, as if it had just been launched.
+func (s *ServerState) BeginReinit(until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.isStarted = false
+	s.isReady = false
+	s.startingUntil = until
+	s.persistLocked()
+}
+
+// FinishReinit marks the server started and ready again, unless a later
+// re-init or startup has replaced the one ending at until. Readiness is
+// restored even if the original startup completed in the meantime, since
+// that startup knew nothing of the re-init.
+func (s *ServerState) FinishReinit(until time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.startingUntil.Equal(until) {
+		return false
+	}
+	if !s.isStarted {
+		s.isStarted = true
+		s.startedAt = s.clock.Now()
+	}
+	s.isReady = true
+	s.persistLocked()
+
+	return true
+}
+
+// StartupRemaining returns how long until startup completes, or zero once
+// the server has started.
+func (s *ServerState) StartupRemaining() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.isStarted {
+		return 0
+	}
+
+	return max(s.startingUntil.Sub(s.clock.Now()), 0)
+}
+
+func (s *ServerState) SetHealthLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.healthLatency = d
+}
+
+func (s *ServerState) HealthLatency() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.healthLatency
+}
+
+func (s *ServerState) SetReadyLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readyLatency = d
+}
+
+func (s *ServerState) ReadyLatency() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.readyLatency
+}
+
+// SetLatencyDist adds a latency sampled from dist to every /healthy and
+// /ready response.
+func (s *ServerState) SetLatencyDist(dist latencyDist) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latencyDist = dist
+}
+
+// SampleLatency draws a latency from the configured distribution, or 0.
+func (s *ServerState) SampleLatency() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.latencyDist.Sample()
+}
+
+// SetLatencyRamp makes /healthy latency grow linearly from zero to max over
+// duration after startup completes, then hold at max.
+func (s *ServerState) SetLatencyRamp(duration, max time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rampDuration = duration
+	s.rampMax = max
+}
+
+// RampLatency returns the current ramped latency for /healthy.
+func (s *ServerState) RampLatency() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.rampMax <= 0 || s.startedAt.IsZero() {
+		return 0
+	}
+
+	elapsed := s.clock.Now().Sub(s.startedAt)
+	if elapsed >= s.rampDuration {
+		return s.rampMax
+	}
+
+	return time.Duration(float64(s.rampMax) * float64(elapsed) / float64(s.rampDuration))
+}
+
+// latencyStep sets the /healthy latency from At, relative to when the
+// profile was loaded, until the next step.
+type latencyStep struct {
+	At      Duration `json:"at"`
+	Latency Duration `json:"latency"`
+}
+
+// SetLatencyProfile replaces the latency timeline and restarts it from now.
+// Steps must be sorted by At; an empty profile clears it.
+func (s *ServerState) SetLatencyProfile(steps []latencyStep) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latencyProfile = steps
+	s.profileLoaded = s.clock.Now()
+}
+
+// ProfileLatency returns the latency of the last profile step that has been
+// reached, holding the final step once the timeline runs out.
+func (s *ServerState) ProfileLatency() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	elapsed := s.clock.Now().Sub(s.profileLoaded)
+	var latency time.Duration
+	for _, step := range s.latencyProfile {
+		if step.At.Duration > elapsed {
+			break
+		}
+		latency = step.Latency.Duration
+	}
+
+	return latency
+}
+
+// SetHealthRedirect makes /healthy answer 302 to target until health is set
+// again.
+func (s *ServerState) SetHealthRedirect(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.healthRedirect = target
+}
+
+func (s *ServerState) HealthRedirect() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.healthRedirect
+}
+
+// SetHealthSequence makes /healthy cycle through codes, one per request,
+// starting from the first.
+func (s *ServerState) SetHealthSequence(codes []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.healthSequence = codes
+	s.sequenceNext = 0
+}
+
+// NextSequenceCode returns the next status code of the health sequence and
+// advances it, or false when no sequence is set.
+func (s *ServerState) NextSequenceCode() (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.healthSequence) == 0 {
+		return 0, false
+	}
+	code := s.healthSequence[s.sequenceNext]
+	s.sequenceNext = (s.sequenceNext + 1) % len(s.healthSequence)
+
+	return code, true
+}
+
+// SetWarmup makes /ready succeed for a growing share of requests over d after
+// startup completes, as if a cache were filling up.
+func (s *ServerState) SetWarmup(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.warmup = d
+}
+
+// WarmupFraction returns the share (0-1) of /ready requests that should
+// currently succeed, which is 1 once the warmup window has passed.
+func (s *ServerState) WarmupFraction() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.warmup <= 0 {
+		return 1
+	}
+	if s.startedAt.IsZero() {
+		return 0
+	}
+
+	return min(1, float64(s.clock.Now().Sub(s.startedAt))/float64(s.warmup))
+}
+
+// SetRole sets the role reported by /ready; a replica fails /ready/write.
+func (s *ServerState) SetRole(role string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.role = role
+}
+
+// Role returns the current role, rolePrimary or roleReplica.
+func (s *ServerState) Role() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.role
+}
+
+// SetReadySchedule makes /ready succeed for the share of requests given by
+// schedule for the time since startup completed.
+func (s *ServerState) SetReadySchedule(schedule readySchedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedule = schedule
+}
+
+// ScheduledFraction returns the share (0-1) of /ready requests the ready
+// schedule currently lets succeed, which is 1 without a schedule.
+func (s *ServerState) ScheduledFraction() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.schedule) == 0 {
+		return 1
+	}
+	if s.startedAt.IsZero() {
+		return 0
+	}
+
+	return s.schedule.Fraction(s.clock.Now().Sub(s.startedAt))
+}
+
+// SetHangUntil makes /healthy block until t before responding.
+func (s *ServerState) SetHangUntil(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hangUntil = t
+}
+
+func (s *ServerState) HangUntil() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.hangUntil
+}
+
+// SetReadyBudget limits how many successful /ready responses are served
+// before the server flips itself to not ready. Zero means unlimited.
+func (s *ServerState) SetReadyBudget(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readyBudget = n
 }
 
-func (s *ServerState) SetHealth(status bool) {
+func (s *ServerState) ReadyBudget() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.readyBudget
+}
+
+// SetUnhealthyThreshold makes the server unhealthy after n consecutive 503
+// responses from /ready, like a watchdog. Zero disables the escalation.
+func (s *ServerState) SetUnhealthyThreshold(n int64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.isHealthy = status
+	s.unhealthyThreshold = n
 }
 
-func (s *ServerState) IsHealthy() bool {
+func (s *ServerState) UnhealthyThreshold() int64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	return s.isHealthy
+	return s.unhealthyThreshold
 }
 
-func (s *ServerState) SetReady(status bool) {
+// SetFailRate makes a healthy /healthy fail with 500 for roughly rate (0-1)
+// of requests; zero disables random failures.
+func (s *ServerState) SetFailRate(rate float64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.isReady = status
+	s.failRate = rate
 }
 
-func (s *ServerState) IsReady() bool {
+func (s *ServerState) FailRate() float64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	return s.isReady
+	return s.failRate
+}
+
+// SetEndpointEnabled makes endpoint answer normally, or with 404 when
+// disabled, to simulate a probe pointed at the wrong path.
+func (s *ServerState) SetEndpointEnabled(endpoint string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if enabled {
+		delete(s.disabled, endpoint)
+		return
+	}
+	if s.disabled == nil {
+		s.disabled = map[string]bool{}
+	}
+	s.disabled[endpoint] = true
+}
+
+func (s *ServerState) EndpointEnabled(endpoint string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return !s.disabled[endpoint]
+}
+
+// SetBodySize makes /healthy return a body of size bytes; zero restores the
+// short default body.
+func (s *ServerState) SetBodySize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bodySize = size
+}
+
+func (s *ServerState) BodySize() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.bodySize
+}
+
+// StartBurn marks a CPU burn as active. It returns false if one is already
+// running, so callers never stack burns.
+func (s *ServerState) StartBurn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isBurning {
+		return false
+	}
+	s.isBurning = true
+
+	return true
+}
+
+func (s *ServerState) StopBurn() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.isBurning = false
+}
+
+func (s *ServerState) IsBurning() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.isBurning
+}
+
+// SetBalloon replaces the held memory balloon; nil releases it.
+func (s *ServerState) SetBalloon(buf []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.balloon = buf
+}
+
+func (s *ServerState) BalloonSize() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.balloon)
+}
+
+// Reset restores the health, readiness and chaos settings to the defaults of
+// NewServerState with no latency, fail rate or ready budget, and restarts the
+// consecutive /ready failure count. Startup progress, hit counters and any
+// running burn or balloon are left alone. It returns the names of the
+// settings that changed.
+func (s *ServerState) Reset() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed []string
+	note := func(name string, modified bool) {
+		if modified {
+			changed = append(changed, name)
+		}
+	}
+	note("healthy", !s.isHealthy || !s.unhealthyUntil.IsZero())
+	note("health_code", s.healthCode != 0)
+	note("ready", !s.isReady)
+	note("fail_rate", s.failRate != 0)
+	note("health_redirect", s.healthRedirect != "")
+	note("health_sequence", len(s.healthSequence) > 0)
+	note("health_latency", s.healthLatency != 0)
+	note("ready_latency", s.readyLatency != 0)
+	note("latency_dist", s.latencyDist != latencyDist{})
+	note("latency_ramp", s.rampDuration != 0 || s.rampMax != 0)
+	note("warmup", s.warmup != 0)
+	note("ready_schedule", len(s.schedule) > 0)
+	note("latency_profile", len(s.latencyProfile) > 0)
+	note("hang", s.clock.Now().Before(s.hangUntil))
+	note("body_size", s.bodySize != 0)
+	note("disabled_endpoints", len(s.disabled) > 0)
+	note("ready_budget", s.readyBudget != 0 || s.readyServed.Load() != 0)
+	note("ready_failures", s.readyFailures.Load() != 0)
+
+	s.isHealthy = true
+	s.isReady = true
+	s.cascadeAt = time.Time{}
+	s.healthCode = 0
+	s.unhealthyUntil = time.Time{}
+	s.failRate = 0
+	s.healthRedirect = ""
+	s.healthSequence = nil
+	s.healthLatency = 0
+	s.readyLatency = 0
+	s.latencyDist = latencyDist{}
+	s.rampDuration = 0
+	s.rampMax = 0
+	s.warmup = 0
+	s.schedule = nil
+	s.latencyProfile = nil
+	s.hangUntil = time.Time{}
+	s.bodySize = 0
+	s.disabled = nil
+	s.readyBudget = 0
+	s.readyServed.Store(0)
+	s.readyFailures.Store(0)
+	s.persistLocked()
+
+	return changed
+}
+
+// stateSnapshot is a point-in-time copy of ServerState for logging.
+type stateSnapshot struct {
+	Role              string        `json:"role"`
+	Started           bool          `json:"started"`
+	Phase             int           `json:"phase,omitempty"`
+	PhaseName         string        `json:"phase_name,omitempty"`
+	Phases            int           `json:"phases,omitempty"`
+	Healthy           bool          `json:"healthy"`
+	Ready             bool          `json:"ready"`
+	Draining          bool          `json:"draining"`
+	HealthCode        int           `json:"health_code"`
+	UnhealthyUntil    time.Time     `json:"unhealthy_until,omitzero"`
+	FailRate          float64       `json:"fail_rate"`
+	HealthRedirect    string        `json:"health_redirect,omitempty"`
+	HealthSequence    []int         `json:"health_sequence,omitempty"`
+	CascadeDelay      string        `json:"cascade_delay"`
+	CascadeAt         time.Time     `json:"cascade_at,omitzero"`
+	HealthLatency     string        `json:"health_latency"`
+	ReadyLatency      string        `json:"ready_latency"`
+	RampLatency       string        `json:"ramp_latency"`
+	LatencyDist       latencyDist   `json:"latency_dist,omitzero"`
+	LatencyProfile    []latencyStep `json:"latency_profile,omitempty"`
+	HangUntil         time.Time     `json:"hang_until,omitzero"`
+	Warmup            string        `json:"warmup"`
+	ReadySchedule     readySchedule `json:"ready_schedule,omitempty"`
+	BodySize          int64         `json:"body_size"`
+	DisabledEndpoints []string      `json:"disabled_endpoints,omitempty"`
+	ReadyBudget       int64         `json:"ready_budget"`
+	ReadyServed       int64         `json:"ready_served"`
+	ReadyFailures     int64         `json:"consecutive_ready_failures"`
+	ExitCode          int           `json:"exit_code"`
+	Burning           bool          `json:"burning"`
+	BalloonBytes      int           `json:"balloon_bytes"`
+	HealthHits        int64         `json:"health_hits"`
+	ReadyHits         int64         `json:"ready_hits"`
+	DebugHits         int64         `json:"debug_hits"`
+	InFlight          int64         `json:"in_flight"`
+}
+
+// Snapshot returns a consistent copy of the current state and counters.
+func (s *ServerState) Snapshot() stateSnapshot {
+	ramp := s.RampLatency()
+	code := s.HealthCode()
+	phase, phaseName, phases := s.Phase()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var disabled []string
+	for endpoint := range s.disabled {
+		disabled = append(disabled, endpoint)
+	}
+	slices.Sort(disabled)
+
+	return stateSnapshot{
+		Role:              s.role,
+		Started:           s.isStarted,
+		Phase:             phase,
+		PhaseName:         phaseName,
+		Phases:            phases,
+		Healthy:           s.healthyLocked(),
+		Ready:             s.isReady,
+		Draining:          s.isDraining,
+		HealthCode:        code,
+		UnhealthyUntil:    s.unhealthyUntil,
+		FailRate:          s.failRate,
+		HealthRedirect:    s.healthRedirect,
+		HealthSequence:    slices.Clone(s.healthSequence),
+		CascadeDelay:      s.cascadeDelay.String(),
+		CascadeAt:         s.cascadeAt,
+		HealthLatency:     s.healthLatency.String(),
+		ReadyLatency:      s.readyLatency.String(),
+		RampLatency:       ramp.String(),
+		LatencyDist:       s.latencyDist,
+		LatencyProfile:    slices.Clone(s.latencyProfile),
+		HangUntil:         s.hangUntil,
+		Warmup:            s.warmup.String(),
+		ReadySchedule:     slices.Clone(s.schedule),
+		BodySize:          s.bodySize,
+		DisabledEndpoints: disabled,
+		ReadyBudget:       s.readyBudget,
+		ReadyServed:       s.readyServed.Load(),
+		ReadyFailures:     s.readyFailures.Load(),
+		ExitCode:          s.exitCode,
+		Burning:           s.isBurning,
+		BalloonBytes:      len(s.balloon),
+		HealthHits:        s.healthHits.Load(),
+		ReadyHits:         s.readyHits.Load(),
+		DebugHits:         s.debugHits.Load(),
+		InFlight:          s.inFlight.Load(),
+	}
 }
 
 func NewServerState() *ServerState {
 	return &ServerState{
+		clock:     newClock(),
 		isHealthy: true,
 		isReady:   true,
 	}
 }
 
-func getStartupDelay() time.Duration {
-	delayFlag := flag.String("t", "", "Startup delay duration(e.g., '30s', '2m'")
+// processStart is captured at the top of main and reported by /debug/stats.
+var processStart time.Time
+
+func main() {
+	processStart = time.Now()
 	flag.Parse()
+	// The file can set the log format and destination, so it is read before
+	// logging is set up.
+	configPath := configFlag.Value()
+	if configPath != "" {
+		if err := loadConfigFile(configPath); err != nil {
+			log.Fatalf("Could not load config file '%s': %v", configPath, err)
+		}
+	}
+	applyEnvVars()
+	setupLogging(logFormatFlag.Value(), logOutput(logFileFlag.Value(), *logStdoutFlag))
+	slog.Info(fmt.Sprintf("slow %s (commit %s, built %s)", version, commit, buildDate), "event", "version", "version", version, "commit", commit, "build_date", buildDate)
+	if configPath != "" {
+		slog.Info(fmt.Sprintf("Loaded settings from config file %s", configPath), "event", "config_loaded", "path", configPath)
+	}
 
-	delayStr := "120s"
+	cfg := loadConfig()
 
-	if val, ok := os.LookupEnv("START_TIME"); ok {
-		delayStr = val
+	state := NewServerState()
+	if cfg.StateFile != "" {
+		if err := state.LoadStateFile(cfg.StateFile); err != nil {
+			log.Fatalf("Could not load state file '%s': %v", cfg.StateFile, err)
+		}
+		slog.Info(fmt.Sprintf("Using state file %s (healthy: %t, ready: %t)", cfg.StateFile, state.IsHealthy(), state.IsReady()),
+			"event", "state_loaded", "path", cfg.StateFile)
 	}
 
-	if *delayFlag != "" {
-		delayStr = *delayFlag
-	}
+	state.SetHealthLatency(cfg.HealthLatency.Duration)
+	state.SetReadyLatency(cfg.ReadyLatency.Duration)
+	state.SetLatencyDist(cfg.LatencyDist)
+	state.SetFailRate(cfg.FailRate)
+	state.SetLatencyRamp(cfg.RampDuration.Duration, cfg.RampMaxLatency.Duration)
+	state.SetWarmup(cfg.Warmup.Duration)
+	state.SetReadySchedule(cfg.ReadySchedule)
+	state.SetRole(cfg.Role)
+	state.SetCascadeDelay(cfg.CascadeDelay.Duration)
+	state.SetReadyBudget(cfg.ReadyBudget)
+	state.SetUnhealthyThreshold(cfg.UnhealthyThreshold)
+	state.SetExitCode(cfg.ExitCode)
+	state.SetStartupDelay(cfg.StartupDelay.Duration)
 
-	log.Printf("Parsing startup delay: %s", delayStr)
-	duration, err := time.ParseDuration(delayStr)
-	if err != nil {
-		log.Fatalf("Invalid format for startup delay '%s'. Error: %v. Please use format like '30s', '5m', '1h'.", delayStr, err)
+	var checks []checker
+	// Background checks already run at a fixed pace, so per-check caching
+	// would only make their results staler.
+	cacheFor := cfg.DependsOnCache.Duration
+	if cfg.CheckInterval.Duration > 0 {
+		cacheFor = 0
+	}
+	if cfg.DependsOn != "" {
+		checks = append(checks, newHTTPCheck(cfg.DependsOn, cfg.DependsOnTimeout.Duration, cacheFor))
+		slog.Info(fmt.Sprintf("Readiness depends on %s", cfg.DependsOn), "event", "dependency_configured", "url", cfg.DependsOn)
+	}
+	if cfg.ReadyTCP != "" {
+		checks = append(checks, newTCPCheck(cfg.ReadyTCP, cfg.DependsOnTimeout.Duration, cacheFor))
+		slog.Info(fmt.Sprintf("Readiness depends on TCP %s", cfg.ReadyTCP), "event", "dependency_configured", "tcp", cfg.ReadyTCP)
+	}
+	if cfg.ReadyFile != "" {
+		checks = append(checks, fileCheck{path: cfg.ReadyFile})
+		slog.Info(fmt.Sprintf("Readiness depends on file %s", cfg.ReadyFile), "event", "dependency_configured", "file", cfg.ReadyFile)
+	}
+	if cfg.ReadyEnv != "" {
+		name, value, _ := strings.Cut(cfg.ReadyEnv, "=")
+		checks = append(checks, envCheck{name: name, value: value})
+		slog.Info(fmt.Sprintf("Readiness depends on environment variable %s", name), "event", "dependency_configured", "env", name)
 	}
 
-	return duration
-}
+	// quit receives shutdown and reload signals; /quitquitquit feeds it too.
+	// Registering before the listeners bind means a SIGTERM during setup or
+	// the startup delay still takes the graceful path below.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 
-func main() {
-	state := NewServerState()
+	runCtx, stopRun := context.WithCancel(context.Background())
+	defer stopRun()
+
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg, state)
 
-	startupDelay := getStartupDelay()
-	if startupDelay > 0 {
-		log.Printf("Waiting %s before starting the server...", startupDelay)
-		time.Sleep(startupDelay)
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.OtelEndpoint != "" {
+		var err error
+		if shutdownTracing, err = setupTracing(runCtx, cfg.OtelEndpoint); err != nil {
+			log.Fatalf("Could not set up tracing for '%s': %v", cfg.OtelEndpoint, err)
+		}
+	}
+
+	// instrument records metrics for endpoint and, when tracing is enabled,
+	// wraps it in a span that continues any incoming trace context.
+	instrument := func(endpoint string, h http.Handler) http.Handler {
+		h = metrics.Instrument(endpoint, h)
+		if cfg.OtelEndpoint != "" {
+			h = otelhttp.NewHandler(h, endpoint)
+		}
+		return h
 	}
 
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/ping", pingHandler())
-	mux.HandleFunc("/healthy", healthHandler(state))
-	mux.HandleFunc("/ready", readyHandler(state))
-	mux.HandleFunc("/debug/", debugHandler(state))
+	mux.HandleFunc("/version", versionHandler())
+	health := allowMethods(addHeaders(cfg.ResponseHeaders, healthHandler(state, cfg.HealthAllow, cfg.TrustProxy)), http.MethodGet, http.MethodHead)
+	cached := cfg.CheckInterval.Duration > 0 && len(checks) > 0
+	ready := allowMethods(addHeaders(cfg.ResponseHeaders, readyHandler(state, checks, cached, false)), http.MethodGet, http.MethodHead)
+	readyWrite := allowMethods(addHeaders(cfg.ResponseHeaders, readyHandler(state, checks, cached, true)), http.MethodGet, http.MethodHead)
+	mux.Handle("/healthy", instrument("/healthy", health))
+	mux.Handle("/ready", instrument("/ready", ready))
+	// Read/write split readiness; only /ready/write fails on a replica.
+	mux.Handle("/ready/read", instrument("/ready/read", ready))
+	mux.Handle("/ready/write", instrument("/ready/write", readyWrite))
+	// Kubernetes-style aliases.
+	mux.Handle("/livez", instrument("/livez", health))
+	mux.Handle("/readyz", instrument("/readyz", ready))
+	mux.Handle("/startup", instrument("/startup", allowMethods(startupHandler(state), http.MethodGet, http.MethodHead)))
+	mux.Handle("/healthz", instrument("/healthz", allowMethods(healthzHandler(state), http.MethodGet, http.MethodHead)))
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+
+	// The debug endpoints share the probe mux unless -debug-addr asks for a
+	// separate listener.
+	debugMux := mux
+	splitDebug := cfg.DebugAddr != "" && cfg.DebugAddr != cfg.ProbeAddr
+	if splitDebug {
+		debugMux = http.NewServeMux()
+	}
+	var limiter *rate.Limiter
+	if cfg.DebugRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(cfg.DebugRate), max(1, int(math.Ceil(cfg.DebugRate))))
+	}
+	// protect applies -debug-token and -debug-rate to the debug actions and
+	// the pprof profiles alike; /debug/pprof/cmdline would reveal the token.
+	protect := func(h http.Handler) http.Handler {
+		if cfg.DebugToken != "" {
+			h = requireToken(string(cfg.DebugToken), h)
+		}
+		if limiter != nil {
+			h = rateLimit(limiter, h)
+		}
+		return h
+	}
+	if cfg.EnableDebug {
+		debugMux.Handle("/debug/", instrument("/debug/*", protect(debugHandler(runCtx, state, cfg))))
+		debugMux.Handle("/quitquitquit", instrument("/quitquitquit", protect(allowMethods(quitHandler(quit), http.MethodPost))))
+	} else {
+		slog.Info("Debug endpoints disabled", "event", "debug_disabled")
+	}
+	if cfg.EnablePprof {
+		// The more specific /debug/pprof/ pattern takes precedence over the
+		// /debug/ action router.
+		debugMux.Handle("/debug/pprof/", protect(http.HandlerFunc(pprof.Index)))
+		debugMux.Handle("/debug/pprof/cmdline", protect(http.HandlerFunc(pprof.Cmdline)))
+		debugMux.Handle("/debug/pprof/profile", protect(http.HandlerFunc(pprof.Profile)))
+		debugMux.Handle("/debug/pprof/symbol", protect(http.HandlerFunc(pprof.Symbol)))
+		debugMux.Handle("/debug/pprof/trace", protect(http.HandlerFunc(pprof.Trace)))
+		slog.Info("Profiling endpoints enabled under /debug/pprof/", "event", "pprof_enabled")
+	}
 
-	server := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+	// All servers share one semaphore so -max-concurrent caps the process
+	// as a whole.
+	var concurrency chan struct{}
+	var exempt []string
+	if cfg.MaxConcurrent > 0 {
+		concurrency = make(chan struct{}, cfg.MaxConcurrent)
+		if cfg.ExemptHealthyLimit {
+			exempt = append(exempt, "/healthy", "/livez")
+		}
+	}
+
+	wrap := func(h http.Handler) http.Handler {
+		h = recoverPanics(cfg.NoRecover, h)
+		if cfg.EnableGzip {
+			h = gzipResponses(h)
+		}
+		if timeout := cfg.RequestTimeout.Duration; timeout > 0 {
+			h = requestTimeout(timeout, h)
+		}
+		if concurrency != nil {
+			h = limitConcurrency(concurrency, exempt, h)
+		}
+		if cfg.AccessLog {
+			h = accessLog(h)
+		}
+		return trackInFlight(&state.inFlight, h)
 	}
 
-	go func() {
-		log.Printf("Server is starting on port 8080...")
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("Could not listen on port 8080: %v", err)
+	var tlsConfig *tls.Config
+	if cfg.TLSCA != "" {
+		tlsConfig = clientAuthConfig(cfg.TLSCA)
+	}
+	newServer := func(addr string, h http.Handler) *http.Server {
+		return &http.Server{
+			Addr:         addr,
+			Handler:      wrap(h),
+			TLSConfig:    tlsConfig.Clone(),
+			ReadTimeout:  cfg.ReadTimeout.Duration,
+			WriteTimeout: cfg.WriteTimeout.Duration,
+			IdleTimeout:  cfg.IdleTimeout.Duration,
 		}
-	}()
-	log.Printf("Server started.")
+	}
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutdown signal received, starting graceful shutdown...")
+	var probeListener net.Listener
+	if cfg.UnixSocket != "" {
+		// Clear a stale socket left behind by a previous unclean exit.
+		if err := os.Remove(cfg.UnixSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("Could not remove existing unix socket '%s': %v", cfg.UnixSocket, err)
+		}
+		probeListener = listen("probe", "unix", cfg.UnixSocket)
+	} else {
+		probeListener = listen("probe", cfg.Network, cfg.ProbeAddr)
+	}
+	state.SetListenAddr(probeListener.Addr().String())
+	if cfg.PortFile != "" {
+		writePortFile(cfg.PortFile, probeListener.Addr())
+	}
+	probeServer := newServer(cfg.ProbeAddr, mux)
+	if cfg.H2C {
+		enableH2C(probeServer)
+	}
+	servers := []namedServer{{
+		name:     "probe",
+		server:   probeServer,
+		listener: probeListener,
+	}}
+	if splitDebug {
+		servers = append(servers, namedServer{
+			name:     "debug",
+			server:   newServer(cfg.DebugAddr, debugMux),
+			listener: listen("debug", cfg.Network, cfg.DebugAddr),
+		})
+	}
+
+	serveErr := make(chan error, len(servers)+1)
+	for _, s := range servers {
+		go s.serve(cfg.TLS, serveErr)
+	}
+
+	var grpcServer *grpc.Server
+	if cfg.GRPCPort != "" {
+		grpcListener := listen("gRPC", cfg.Network, ":"+cfg.GRPCPort)
+		grpcServer = newGRPCServer(runCtx, state, cfg.Reflection)
+		go func() {
+			slog.Info(fmt.Sprintf("Starting gRPC health server on %s...", grpcListener.Addr()), "event", "server_starting", "server", "grpc", "addr", grpcListener.Addr().String())
+			if err := grpcServer.Serve(grpcListener); err != nil {
+				serveErr <- fmt.Errorf("grpc server: %w", err)
+			}
+		}()
+	}
+
+	// Every listener is bound by now, so a taken port has already been
+	// reported and the startup clock only runs once we can serve.
+	if cfg.StartupFile != "" {
+		go runStartupFile(runCtx, state, cfg.StartupFile)
+	} else if len(cfg.Phases) > 0 {
+		go runPhases(runCtx, state, cfg.Phases, cfg.PhaseDuration.Duration)
+	} else {
+		go runStartup(runCtx, state, applyJitter(cfg.StartupDelay.Duration, cfg.Jitter.Duration))
+	}
+	if cfg.StartupDeadline.Duration > 0 {
+		go enforceStartupDeadline(runCtx, state, checks, cfg.StartupDeadline.Duration)
+	}
+
+	if cfg.CheckInterval.Duration > 0 && len(checks) > 0 {
+		go pollChecks(runCtx, state, checks, cfg.CheckInterval.Duration)
+	}
+	if cfg.FlapInterval.Duration > 0 {
+		go flapHealth(runCtx, state, cfg.FlapInterval.Duration)
+	}
+	if cfg.Heartbeat.Duration > 0 {
+		go heartbeat(runCtx, state, cfg.Heartbeat.Duration)
+	}
+
+	slog.Info(fmt.Sprintf("Server started, probes listening on %s.", state.ListenAddr()), "event", "server_started", "addr", state.ListenAddr())
+
+wait:
+	for {
+		select {
+		case err := <-serveErr:
+			log.Fatalf("Server stopped serving: %v", err)
+		case sig := <-quit:
+			switch sig {
+			case syscall.SIGHUP:
+				reloadSettings(state)
+			case syscall.SIGUSR1:
+				logStateSnapshot(state.Snapshot())
+			default:
+				break wait
+			}
+		}
+	}
+	slog.Info("Shutdown signal received, starting graceful shutdown...", "event", "shutdown_started")
+	stopRun()
+	go forceExitOnSignal(quit, cfg.UnixSocket)
+
+	if cfg.FastShutdown {
+		inFlight := state.inFlight.Load()
+		slog.Info(fmt.Sprintf("Fast shutdown: closing all connections now, dropping %d in-flight requests.", inFlight),
+			"event", "fast_shutdown", "in_flight", inFlight)
+		err := closeServers(servers)
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		removeUnixSocket(cfg.UnixSocket)
+		if err != nil {
+			log.Fatalf("Fast shutdown failed: %v", err)
+		}
+		exit(state)
+		return
+	}
+
+	// Fail /ready before the listeners close so endpoints are deregistered
+	// while requests still succeed. Draining rather than SetReady(false)
+	// keeps the not-ready state out of the state file.
+	state.SetDraining(true)
+	logStateChange("/ready", "draining", "State changed: shutting down, /ready will now return 503")
+	disableKeepAlives(servers)
+
+	if predrain := cfg.Predrain.Duration; predrain > 0 {
+		slog.Info(fmt.Sprintf("Pre-drain: waiting %s before closing listeners...", predrain),
+			"event", "predrain_started", "duration", predrain.String())
+		time.Sleep(predrain)
+		slog.Info("Pre-drain complete, shutting down server...", "event", "predrain_completed")
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownTimeout := cfg.ShutdownTimeout.Duration
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+	shutdownStart := time.Now()
+	inFlight := state.inFlight.Load()
+	slog.Info(fmt.Sprintf("Draining %d in-flight requests...", inFlight), "event", "drain_started", "in_flight", inFlight)
+	drained := make(chan struct{})
+	go logDrain(&state.inFlight, drained)
+	err := shutdownServers(ctx, servers)
+	if cfg.H2C && err == nil {
+		err = awaitInFlight(ctx, &state.inFlight)
+	}
+	close(drained)
+	if grpcServer != nil {
+		err = errors.Join(err, stopGRPCServer(ctx, grpcServer))
+	}
+	if err != nil {
+		log.Fatalf("Server forced to shutdown after %s (budget %s): %v", time.Since(shutdownStart), shutdownTimeout, err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error(fmt.Sprintf("Could not flush traces: %v", err), "event", "tracing_shutdown_failed")
+	}
+	removeUnixSocket(cfg.UnixSocket)
+	shutdownTook := time.Since(shutdownStart)
+	slog.Info(fmt.Sprintf("Graceful shutdown completed in %s (budget %s).", shutdownTook, shutdownTimeout),
+		"event", "shutdown_completed", "duration", shutdownTook.String(), "budget", shutdownTimeout.String())
+	exit(state)
+}
+
+// forceExitOnSignal exits at once when another SIGINT or SIGTERM arrives
+// while a graceful shutdown is under way, e.g. because a drain has stalled.
+func forceExitOnSignal(quit <-chan os.Signal, unixSocket string) {
+	for sig := range quit {
+		if sig != syscall.SIGINT && sig != syscall.SIGTERM {
+			continue
+		}
+		slog.Error(fmt.Sprintf("Second shutdown signal (%s) received while draining, exiting immediately.", sig), "event", "forced_exit", "signal", sig.String())
+		removeUnixSocket(unixSocket)
+		os.Exit(1)
+	}
+}
+
+// exit logs the final message and ends the process with the configured exit
+// code. A zero code returns so deferred cleanup still runs.
+func exit(s *ServerState) {
+	code := s.ExitCode()
+	if code == 0 {
+		slog.Info("Server exiting.", "event", "server_exiting", "exit_code", code)
+		return
 	}
-	log.Println("Server exiting.")
+
+	slog.Info(fmt.Sprintf("Server exiting with code %d.", code), "event", "server_exiting", "exit_code", code)
+	os.Exit(code)
 }
 
 var ping int
@@ -130,53 +1375,388 @@ func pingHandler() http.HandlerFunc {
 	}
 }
 
-func healthHandler(s *ServerState) http.HandlerFunc {
+// sleepContext pauses for d, returning early with the context error if ctx
+// is done first (e.g. the client went away).
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type probeResponse struct {
+	Status    string        `json:"status"`
+	Healthy   bool          `json:"healthy"`
+	Ready     bool          `json:"ready"`
+	Timestamp time.Time     `json:"timestamp"`
+	Error     string        `json:"error,omitempty"`
+	Addr      string        `json:"addr,omitempty"`
+	Role      string        `json:"role,omitempty"`
+	Checks    []checkStatus `json:"checks,omitempty"`
+
+	CheckAge        string  `json:"check_age,omitempty"`
+	CheckAgeSeconds float64 `json:"check_age_seconds,omitempty"`
+}
+
+func newProbeResponse(s *ServerState, status string) probeResponse {
+	return probeResponse{
+		Status:    status,
+		Healthy:   s.IsHealthy(),
+		Ready:     s.IsReady(),
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// wantsJSON reports whether the client asked for a JSON body via Accept.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error(fmt.Sprintf("Failed to encode JSON response: %v", err), "event", "encode_error")
+	}
+}
+
+// healthHandler serves /healthy. Clients outside a non-empty allowed list
+// get 503 whatever the health state, simulating a server that is only
+// healthy to some peers.
+func healthHandler(s *ServerState, allowed cidrList, trustProxy bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if s.IsHealthy() {
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, "HEALTHY")
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "UNHEALTHY")
+		s.healthHits.Add(1)
+		s.healthWindow.Add(time.Now())
+		if !s.EndpointEnabled("/healthy") {
+			http.NotFound(w, r)
+			return
+		}
+		if err := sleepClock(r.Context(), s.clock, s.HangUntil().Sub(s.clock.Now())); err != nil {
+			return
+		}
+		if err := sleepContext(r.Context(), s.HealthLatency()+s.RampLatency()+s.ProfileLatency()+s.SampleLatency()); err != nil {
+			return
+		}
+
+		allowedPeer := peerAllowed(allowed, trustProxy, r)
+		if target := s.HealthRedirect(); target != "" && allowedPeer {
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+
+		var healthErr, failErr error
+		code := s.HealthCode()
+		if !allowedPeer {
+			code = http.StatusServiceUnavailable
+			healthErr = errors.New("client not in -health-allow-cidr")
+		} else if code >= http.StatusBadRequest {
+			healthErr = fmt.Errorf("status %d", code)
+		} else if next, ok := s.NextSequenceCode(); ok {
+			code = next
+			if code >= http.StatusBadRequest {
+				healthErr = fmt.Errorf("status %d from sequence", code)
+			}
+		} else if rand.Float64() < s.FailRate() {
+			code = http.StatusInternalServerError
+			failErr = errors.New("injected failure")
+		}
+		status := "healthy"
+		if code >= http.StatusBadRequest {
+			status = "unhealthy"
+		}
+
+		if wantsJSON(r) {
+			resp := newProbeResponse(s, status)
+			resp.Healthy = code < http.StatusBadRequest
+			writeJSON(w, code, resp)
+			return
+		}
+
+		if r.URL.Query().Has("verbose") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(code)
+			writeVerbose(w, strings.TrimPrefix(r.URL.Path, "/"), []checkResult{
+				{name: "ping"},
+				{name: "health", err: healthErr},
+				{name: "fail-rate", err: failErr},
+			})
+			return
+		}
+
+		if size := s.BodySize(); size > 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			w.WriteHeader(code)
+			writePatternBody(w, size)
+			return
+		}
+
+		w.WriteHeader(code)
+		fmt.Fprint(w, strings.ToUpper(status))
+	}
+}
+
+// checkResult is one line of a verbose probe breakdown.
+type checkResult struct {
+	name string
+	err  error
+}
+
+// writeVerbose writes a Kubernetes-style per-check breakdown, e.g.
+// "[+]ping ok", followed by an overall "<probe> check passed" line.
+func writeVerbose(w io.Writer, probe string, results []checkResult) {
+	passed := true
+	for _, res := range results {
+		if res.err != nil {
+			passed = false
+			fmt.Fprintf(w, "[-]%s failed: %v\n", res.name, res.err)
+			continue
+		}
+		fmt.Fprintf(w, "[+]%s ok\n", res.name)
+	}
+
+	if passed {
+		fmt.Fprintf(w, "%s check passed\n", probe)
+		return
+	}
+	fmt.Fprintf(w, "%s check failed\n", probe)
+}
+
+// writePatternBody writes size bytes of a repeating a-z pattern so clients
+// can verify the body they received.
+func writePatternBody(w io.Writer, size int64) {
+	chunk := make([]byte, 32*1024)
+	for i := range chunk {
+		chunk[i] = byte('a' + i%26)
+	}
+
+	for size > 0 {
+		n := min(size, int64(len(chunk)))
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return
+		}
+		size -= n
+	}
+}
+
+// streamChunksPerSecond is how many flushed writes streamPatternBody makes
+// per second when the rate allows it.
+const streamChunksPerSecond = 10
+
+// streamPatternBody drips size bytes of the writePatternBody pattern at
+// roughly rate bytes per second, flushing after each chunk so the client
+// sees the body arrive slowly. It stops early once ctx is done.
+func streamPatternBody(ctx context.Context, w http.ResponseWriter, size, rate int64) error {
+	rc := http.NewResponseController(w)
+	chunk := max(1, rate/streamChunksPerSecond)
+	interval := time.Duration(float64(time.Second) * float64(chunk) / float64(rate))
+	buf := make([]byte, chunk)
+
+	for sent := int64(0); sent < size; {
+		n := min(chunk, size-sent)
+		for i := range n {
+			buf[i] = byte('a' + (sent+i)%26)
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		if err := rc.Flush(); err != nil {
+			return err
+		}
+		sent += n
+
+		if sent < size {
+			if err := sleepContext(ctx, interval); err != nil {
+				return err
+			}
 		}
 	}
+
+	return nil
 }
 
-func readyHandler(s *ServerState) http.HandlerFunc {
+// readyHandler reports readiness. A manual /debug/noready always wins;
+// otherwise every configured dependency check must also pass. With cached set
+// the checks run in the background (see pollChecks) and their last result is
+// reported instead. With write set it also fails while the server is a
+// replica, so /ready/write and /ready/read can split traffic.
+func readyHandler(s *ServerState, checks []checker, cached, write bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if s.IsReady() {
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintln(w, "READY")
+		s.readyHits.Add(1)
+		s.readyWindow.Add(time.Now())
+		if !s.EndpointEnabled("/ready") {
+			http.NotFound(w, r)
+			return
+		}
+		if err := sleepContext(r.Context(), s.ReadyLatency()+s.SampleLatency()); err != nil {
+			return
+		}
+
+		code, status := http.StatusOK, "ready"
+		var results []checkStatus
+		var depErr error
+		var checkedAt time.Time
+		if !s.IsReady() {
+			code, status = http.StatusInternalServerError, "noready"
+		} else if !s.IsStarted() {
+			code, status = http.StatusServiceUnavailable, "starting"
+		} else if s.IsDraining() {
+			code, status = http.StatusServiceUnavailable, "draining"
 		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintln(w, "NOREADY")
+			if cached {
+				results, checkedAt, depErr = s.CheckResults()
+			} else {
+				results, depErr = runChecks(r.Context(), checks)
+			}
+			if depErr != nil {
+				code, status = http.StatusServiceUnavailable, "noready"
+			}
+		}
+		if code == http.StatusOK && rand.Float64() >= s.WarmupFraction() {
+			code, status = http.StatusServiceUnavailable, "warming"
+		}
+		if code == http.StatusOK && rand.Float64() >= s.ScheduledFraction() {
+			code, status = http.StatusServiceUnavailable, "scheduled"
+		}
+		role := s.Role()
+		if write && code == http.StatusOK && role == roleReplica {
+			code, status = http.StatusServiceUnavailable, "replica"
+		}
+
+		if budget := s.ReadyBudget(); budget > 0 && code == http.StatusOK {
+			if served := s.readyServed.Add(1); served > budget {
+				s.SetReady(false)
+				if served == budget+1 {
+					logStateChange("/ready", "noready", fmt.Sprintf("Ready budget of %d requests exhausted: /ready will now return 500", budget))
+				}
+				code, status = http.StatusInternalServerError, "noready"
+			}
+		}
+
+		// Only dependency and manual readiness failures of a started server
+		// count toward the threshold; starting, draining, warming and
+		// scheduled 503s are expected and must not cost liveness.
+		switch {
+		case code == http.StatusOK:
+			s.readyFailures.Store(0)
+		case status == "noready" && s.IsStarted() && !s.IsDraining():
+			failures := s.readyFailures.Add(1)
+			if threshold := s.UnhealthyThreshold(); threshold > 0 && failures >= threshold && s.IsHealthy() {
+				s.SetHealth(false)
+				logStateChange("/healthy", "unhealthy", fmt.Sprintf("%d consecutive /ready failures: /healthy will now return 500", failures))
+			}
+		}
+
+		w.Header().Set("X-Role", role)
+		if wantsJSON(r) {
+			resp := newProbeResponse(s, status)
+			resp.Ready = code == http.StatusOK
+			resp.Addr = s.ListenAddr()
+			resp.Role = role
+			resp.Checks = results
+			if !checkedAt.IsZero() {
+				age := s.clock.Now().Sub(checkedAt)
+				resp.CheckAge, resp.CheckAgeSeconds = age.String(), age.Seconds()
+			}
+			if depErr != nil {
+				resp.Error = depErr.Error()
+			}
+			writeJSON(w, code, resp)
+			return
+		}
+
+		w.WriteHeader(code)
+		fmt.Fprintln(w, strings.ToUpper(status))
+	}
+}
+
+type startupResponse struct {
+	Status           string    `json:"status"`
+	Started          bool      `json:"started"`
+	RemainingSeconds float64   `json:"remaining_seconds"`
+	Phase            int       `json:"phase,omitempty"`
+	PhaseName        string    `json:"phase_name,omitempty"`
+	Phases           int       `json:"phases,omitempty"`
+	Timestamp        time.Time `json:"timestamp"`
+}
+
+func startupHandler(s *ServerState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := startupResponse{
+			Status:           "started",
+			Started:          s.IsStarted(),
+			RemainingSeconds: s.StartupRemaining().Seconds(),
+			Timestamp:        time.Now().UTC(),
 		}
+		resp.Phase, resp.PhaseName, resp.Phases = s.Phase()
+
+		if !resp.Started {
+			resp.Status = "starting"
+			writeJSON(w, http.StatusServiceUnavailable, resp)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
 	}
 }
 
-func debugHandler(s *ServerState) http.HandlerFunc {
+// quitHandler starts the same graceful shutdown as SIGTERM, answering before
+// the servers begin to drain.
+func quitHandler(quit chan<- os.Signal) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		action := r.URL.Path[len("/debug/"):]
-
-		switch action {
-		case "healthy":
-			s.SetHealth(true)
-			log.Println("State changed: /healthy will now return 200")
-			fmt.Fprintln(w, "Health status set to HEALTHY (200 OK)")
-		case "unhealthy":
-			s.SetHealth(false)
-			log.Println("State changed: /healthy will now return 500")
-			fmt.Fprintln(w, "Health status set to UNHEALTHY (500 Internal Server Error)")
-		case "ready":
-			s.SetReady(true)
-			log.Println("State changed: /ready will now return 200")
-			fmt.Fprintln(w, "Ready status set to READY (200 OK)")
-		case "noready":
-			s.SetReady(false)
-			log.Println("State changed: /ready will now return 500")
-			fmt.Fprintln(w, "Ready status set to NOREADY (500 Internal Server Error)")
+		slog.Info(fmt.Sprintf("Shutdown requested over HTTP by %s", r.RemoteAddr), "event", "quit_requested", "remote_addr", r.RemoteAddr)
+		fmt.Fprintln(w, "Shutting down")
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		select {
+		case quit <- syscall.SIGTERM:
 		default:
-			http.NotFound(w, r)
+			// A shutdown signal is already pending.
 		}
 	}
 }
+
+// maxBodySize caps /debug/body so a typo can't make every probe allocate
+// or stream gigabytes.
+const maxBodySize = 64 << 20
+
+// maxLatencyProfileSize caps the /debug/latency-profile request body.
+const maxLatencyProfileSize = 1 << 20
+
+// statusClientClosedRequest is the non-standard code nginx uses for requests
+// the client abandoned before a response was sent.
+const statusClientClosedRequest = 499
+
+type statsResponse struct {
+	HealthHits    int64     `json:"health_hits"`
+	ReadyHits     int64     `json:"ready_hits"`
+	DebugHits     int64     `json:"debug_hits"`
+	ReadyFailures int64     `json:"consecutive_ready_failures"`
+	HealthRate    float64   `json:"health_rps"`
+	ReadyRate     float64   `json:"ready_rps"`
+	DebugRate     float64   `json:"debug_rps"`
+	RateWindow    string    `json:"rate_window"`
+	StartTime     time.Time `json:"start_time"`
+	Uptime        string    `json:"uptime"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+}
+
+type runtimeResponse struct {
+	Alloc        uint64 `json:"alloc_bytes"`
+	TotalAlloc   uint64 `json:"total_alloc_bytes"`
+	Sys          uint64 `json:"sys_bytes"`
+	HeapInuse    uint64 `json:"heap_inuse_bytes"`
+	NumGC        uint32 `json:"num_gc"`
+	NumGoroutine int    `json:"num_goroutine"`
+	NumCPU       int    `json:"num_cpu"`
+	GOMAXPROCS   int    `json:"gomaxprocs"`
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Metrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// NewMetrics creates the server collectors and registers them with reg. The
+// health and ready gauges are read from s on every scrape.
+func NewMetrics(reg prometheus.Registerer, s *ServerState) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slow_http_requests_total",
+			Help: "Total number of HTTP requests by endpoint and status code.",
+		}, []string{"endpoint", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "slow_http_request_duration_seconds",
+			Help:    "Handler latency in seconds by endpoint.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint"}),
+	}
+
+	reg.MustRegister(
+		m.requests,
+		m.duration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "slow_healthy",
+			Help: "Whether /healthy currently reports healthy (1) or not (0).",
+		}, func() float64 { return boolToFloat(s.IsHealthy()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "slow_ready",
+			Help: "Whether /ready currently reports ready (1) or not (0).",
+		}, func() float64 { return boolToFloat(s.IsReady()) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Instrument wraps next so that its requests and latency are recorded under
+// the given endpoint label.
+func (m *Metrics) Instrument(endpoint string, next http.Handler) http.Handler {
+	labels := prometheus.Labels{"endpoint": endpoint}
+
+	return promhttp.InstrumentHandlerDuration(m.duration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(m.requests.MustCurryWith(labels), next))
+}
+
+// healthzHandler reports IsHealthy as a single Prometheus gauge, 'up 1' or
+// 'up 0', for scrapers that want health as a metric rather than a probe. It
+// always answers 200 so the scrape itself succeeds; clients that accept JSON
+// get {"up": 1} instead.
+func healthzHandler(s *ServerState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		up := int(boolToFloat(s.IsHealthy()))
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, map[string]int{"up": up})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprintln(w, "# HELP up Whether /healthy currently reports healthy (1) or not (0).")
+		fmt.Fprintln(w, "# TYPE up gauge")
+		fmt.Fprintf(w, "up %d\n", up)
+	}
+}
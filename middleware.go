@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimit rejects requests beyond the limiter's budget with 429 and a
+// Retry-After header telling the client when a token will be available.
+func rateLimit(limiter *rate.Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reservation := limiter.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			retryAfter := int(math.Ceil(delay.Seconds()))
+			slog.Info(fmt.Sprintf("Rate limit exceeded for %s from %s", r.URL.Path, r.RemoteAddr),
+				"event", "rate_limited", "endpoint", r.URL.Path, "remote_addr", r.RemoteAddr)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "Too many debug requests, slow down", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitConcurrency responds 503 immediately, rather than queueing, when sem
+// has no free slot. Requests for paths in exempt bypass the limit.
+func limitConcurrency(sem chan struct{}, exempt []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(exempt, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		default:
+			slog.Info(fmt.Sprintf("Concurrency limit of %d reached, rejecting %s from %s", cap(sem), r.URL.Path, r.RemoteAddr),
+				"event", "concurrency_limited", "endpoint", r.URL.Path, "remote_addr", r.RemoteAddr, "limit", cap(sem))
+			http.Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// requestTimeout bounds each request to timeout through its context. A
+// handler that gives up at the deadline without writing a response gets a 503
+// written on its behalf.
+func requestTimeout(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			slog.Info(fmt.Sprintf("Request timeout of %s exceeded for %s", timeout, r.URL.Path),
+				"event", "request_timeout", "endpoint", r.URL.Path, "timeout", timeout.String())
+			http.Error(w, fmt.Sprintf("Request exceeded the %s timeout", timeout), http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// recoverPanics turns a panic in next into a logged stack trace and a 500, so
+// one bad request does not cost the client its connection. With crash set it
+// re-raises the panic on a fresh goroutine instead, beyond net/http's own
+// recovery, so the process exits uncleanly. http.ErrAbortHandler is always
+// re-raised in place since it only asks to drop the connection.
+func recoverPanics(crash bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			stack := string(debug.Stack())
+			msg := fmt.Sprintf("Recovered from panic serving %s: %v", r.URL.Path, rec)
+			event := "panic_recovered"
+			if crash {
+				msg = fmt.Sprintf("Panic serving %s: %v, crashing since -no-recover is set", r.URL.Path, rec)
+				event = "panic_crash"
+			}
+			if _, plain := slog.Default().Handler().(plainHandler); plain {
+				msg += "\n" + stack
+			}
+			slog.Error(msg, "event", event, "endpoint", r.URL.Path, "panic", fmt.Sprint(rec), "stack", stack)
+			if crash {
+				go panic(rec)
+				select {}
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// addHeaders sets header on every response from next.
+func addHeaders(header http.Header, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireToken rejects requests without an "Authorization: Bearer <token>"
+// header matching token with 401. The comparison is constant-time.
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			slog.Info(fmt.Sprintf("Rejected unauthenticated request for %s from %s", r.URL.Path, r.RemoteAddr),
+				"event", "unauthorized", "endpoint", r.URL.Path, "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="slow debug"`)
+			http.Error(w, "Missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// peerAllowed reports whether the client of r is in allowed, or true when no
+// networks are configured. With trustProxy the first X-Forwarded-For address
+// counts as the client instead of the connection's peer.
+func peerAllowed(allowed cidrList, trustProxy bool, r *http.Request) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	ip := clientIP(r, trustProxy)
+
+	return ip != nil && allowed.Contains(ip)
+}
+
+// clientIP returns the request's client address, or nil if it cannot be
+// parsed.
+func clientIP(r *http.Request, trustProxy bool) net.IP {
+	if forwarded := r.Header.Get("X-Forwarded-For"); trustProxy && forwarded != "" {
+		first, _, _ := strings.Cut(forwarded, ",")
+		return net.ParseIP(strings.TrimSpace(first))
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// allowMethods responds 405 with an Allow header to requests whose method is
+// not in methods.
+func allowMethods(next http.Handler, methods ...string) http.Handler {
+	allow := strings.Join(methods, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("Allow", allow)
+		http.Error(w, fmt.Sprintf("Method %s not allowed, use %s", r.Method, allow), http.StatusMethodNotAllowed)
+	})
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer's
+// Flusher and Hijacker implementations.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// accessLog logs method, path, status and duration of every request.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		duration := time.Since(start)
+		slog.Info(fmt.Sprintf("%s %s %d %s", r.Method, r.URL.Path, status, duration),
+			"event", "access", "method", r.Method, "endpoint", r.URL.Path, "status", status,
+			"duration", duration.String(), "remote_addr", r.RemoteAddr)
+	})
+}
+
+// trackInFlight counts the requests currently being handled by next.
+func trackInFlight(counter *atomic.Int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter.Add(1)
+		defer counter.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
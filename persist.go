@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistedState is the on-disk form of the state kept across restarts.
+type persistedState struct {
+	Healthy bool `json:"healthy"`
+	Ready   bool `json:"ready"`
+	Started bool `json:"started"`
+
+	// UnhealthyUntil is set while a temporary /debug/unhealthy/<duration>
+	// is in effect, so the expiry survives a restart too.
+	UnhealthyUntil time.Time `json:"unhealthy_until,omitzero"`
+}
+
+// LoadStateFile restores health/ready/started from path if it exists and
+// makes every later state change write back to it.
+func (s *ServerState) LoadStateFile(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stateFile = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var ps persistedState
+	if err := json.Unmarshal(data, &ps); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	s.isHealthy = ps.Healthy
+	s.isReady = ps.Ready
+	s.isStarted = ps.Started
+	s.unhealthyUntil = ps.UnhealthyUntil
+	// A restored start begins now for warmup, ramps and schedules, since
+	// SetStarted will not see a transition to record it.
+	if ps.Started {
+		s.startedAt = s.clock.Now()
+	}
+
+	return nil
+}
+
+// persistLocked writes the current state to the state file, if configured.
+// The caller must hold s.mu.
+func (s *ServerState) persistLocked() {
+	if s.stateFile == "" {
+		return
+	}
+
+	data, err := json.Marshal(persistedState{
+		Healthy: s.isHealthy,
+		Ready:   s.isReady,
+		Started: s.isStarted,
+
+		UnhealthyUntil: s.unhealthyUntil,
+	})
+	if err == nil {
+		err = writeFileAtomic(s.stateFile, data)
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to write state file %s: %v", s.stateFile, err), "event", "state_file_error", "path", s.stateFile)
+	}
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into
+// place so a crash never leaves a half-written state file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
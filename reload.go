@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// reloadSettings re-resolves the latency settings with the same flag > env >
+// default precedence used at startup and applies any that changed. Invalid
+// values are logged and the current setting is kept. The startup delay is not
+// reloaded: the startup wait is scheduled once, after -max-startup-delay and
+// SKIP_STARTUP_DELAY have been applied, and a new value would change nothing.
+func reloadSettings(s *ServerState) {
+	slog.Info("SIGHUP received, reloading settings...", "event", "reload_started")
+
+	changed := false
+	changed = reloadDuration("health latency", healthLatencyFlag.Value(), s.HealthLatency, s.SetHealthLatency) || changed
+	changed = reloadDuration("ready latency", readyLatencyFlag.Value(), s.ReadyLatency, s.SetReadyLatency) || changed
+
+	if !changed {
+		slog.Info("Reload complete, no settings changed.", "event", "reload_completed")
+		return
+	}
+	slog.Info("Reload complete.", "event", "reload_completed")
+}
+
+func reloadDuration(name, value string, get func() time.Duration, set func(time.Duration)) bool {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		slog.Error(fmt.Sprintf("Ignoring invalid %s '%s' on reload", name, value), "event", "reload_invalid", "setting", name, "value", value)
+		return false
+	}
+
+	old := get()
+	if old == d {
+		return false
+	}
+	set(d)
+	slog.Info(fmt.Sprintf("Reloaded %s: %s -> %s", name, old, d), "event", "setting_reloaded", "setting", name, "old", old.String(), "new", d.String())
+
+	return true
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// drainLogInterval is how often logDrain reports the in-flight count.
+const drainLogInterval = time.Second
+
+// namedServer is one of the HTTP servers run by main, e.g. the probe server
+// and an optional separate debug server.
+type namedServer struct {
+	name     string
+	server   *http.Server
+	listener net.Listener
+}
+
+// listen binds addr on network for the named server, exiting if it cannot.
+// Binding up front, rather than in ListenAndServe, reports a taken port
+// before main claims the server has started.
+func listen(name, network, addr string) net.Listener {
+	listener, err := net.Listen(network, addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		log.Fatalf("Could not listen for %s server: %s is already in use by another process.", name, addr)
+	}
+	if err != nil {
+		log.Fatalf("Could not listen for %s server on %s (%s): %v", name, addr, network, err)
+	}
+
+	family := addrFamily(network, listener.Addr())
+	slog.Info(fmt.Sprintf("Bound %s listener on %s (%s)", name, listener.Addr(), family),
+		"event", "listening", "server", name, "addr", listener.Addr().String(), "family", family)
+
+	return listener
+}
+
+// writePortFile writes the port of addr to path, atomically so a harness
+// polling for the file never reads a partial number. It exits on failure since
+// the harness would otherwise wait forever.
+func writePortFile(path string, addr net.Addr) {
+	port := addr.(*net.TCPAddr).Port
+	if err := writeFileAtomic(path, fmt.Appendf(nil, "%d\n", port)); err != nil {
+		log.Fatalf("Could not write port file '%s': %v", path, err)
+	}
+	slog.Info(fmt.Sprintf("Wrote probe port %d to %s", port, path), "event", "port_file_written", "path", path, "port", port)
+}
+
+// addrFamily reports whether a listener accepts IPv4, IPv6 or both. An
+// unspecified IPv6 address on plain "tcp" is dual-stack.
+func addrFamily(network string, addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return network
+	}
+
+	switch {
+	case tcpAddr.IP.To4() != nil:
+		return "ipv4"
+	case network == "tcp" && tcpAddr.IP.IsUnspecified():
+		return "dual-stack"
+	default:
+		return "ipv6"
+	}
+}
+
+// serve runs s until it is shut down. Any error other than
+// http.ErrServerClosed is sent to errCh so main can treat it as fatal.
+func (s namedServer) serve(useTLS bool, errCh chan<- error) {
+	where := s.listener.Addr().String()
+	slog.Info(fmt.Sprintf("Starting %s server on %s (tls: %t)...", s.name, where, useTLS),
+		"event", "server_starting", "server", s.name, "addr", where, "tls", useTLS)
+
+	var err error
+	if useTLS {
+		err = s.server.ServeTLS(s.listener, tlsCertFlag.Value(), tlsKeyFlag.Value())
+	} else {
+		err = s.server.Serve(s.listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errCh <- fmt.Errorf("%s server: %w", s.name, err)
+	}
+}
+
+// closeServers closes all servers immediately, dropping active connections
+// instead of letting them drain.
+func closeServers(servers []namedServer) error {
+	var errs []error
+	for _, s := range servers {
+		if err := s.server.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s server: %w", s.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// removeUnixSocket deletes the socket file at path, if one is configured.
+func removeUnixSocket(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error(fmt.Sprintf("Could not remove unix socket '%s': %v", path, err), "event", "unix_socket_cleanup_failed")
+	}
+}
+
+// disableKeepAlives closes connections after their current request so that
+// keep-alive clients reconnect instead of stalling Shutdown.
+func disableKeepAlives(servers []namedServer) {
+	for _, s := range servers {
+		s.server.SetKeepAlivesEnabled(false)
+	}
+	slog.Info("Keep-alives disabled, idle connections closed.", "event", "keepalives_disabled")
+}
+
+// clientAuthConfig returns a TLS config that rejects clients without a
+// certificate signed by a CA in the PEM bundle at path.
+func clientAuthConfig(path string) *tls.Config {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Could not read TLS client CA '%s': %v", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		log.Fatalf("No PEM certificates found in TLS client CA '%s'.", path)
+	}
+	slog.Info(fmt.Sprintf("Requiring client certificates signed by %s", path), "event", "mtls_enabled", "client_ca", path)
+
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+}
+
+// enableH2C lets server speak HTTP/2 over cleartext alongside HTTP/1.1.
+// Configuring h2s on the server makes Shutdown send GOAWAY on h2c
+// connections as well.
+func enableH2C(server *http.Server) {
+	h2s := &http2.Server{IdleTimeout: server.IdleTimeout}
+	if err := http2.ConfigureServer(server, h2s); err != nil {
+		log.Fatalf("Could not enable h2c: %v", err)
+	}
+	server.Handler = h2c.NewHandler(server.Handler, h2s)
+}
+
+// inFlightPollInterval is how often awaitInFlight checks for idle.
+const inFlightPollInterval = 50 * time.Millisecond
+
+// awaitInFlight waits until no requests are in flight or ctx is done. h2c
+// connections are hijacked from the server, so Shutdown does not wait for
+// the requests on them.
+func awaitInFlight(ctx context.Context, inFlight *atomic.Int64) error {
+	ticker := time.NewTicker(inFlightPollInterval)
+	defer ticker.Stop()
+
+	for inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// shutdownServers gracefully shuts down all servers in parallel and joins
+// their errors.
+func shutdownServers(ctx context.Context, servers []namedServer) error {
+	errs := make([]error, len(servers))
+
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.server.Shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("%s server: %w", s.name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// logDrain periodically logs the number of in-flight requests until done is
+// closed.
+func logDrain(inFlight *atomic.Int64, done <-chan struct{}) {
+	ticker := time.NewTicker(drainLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			n := inFlight.Load()
+			slog.Info(fmt.Sprintf("Still draining, %d requests in flight", n), "event", "drain_progress", "in_flight", n)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KIB", 1 << 10},
+	{"MIB", 1 << 20},
+	{"GIB", 1 << 30},
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"KI", 1 << 10},
+	{"MI", 1 << 20},
+	{"GI", 1 << 30},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"B", 1},
+}
+
+// parseSize parses human-readable sizes such as "512", "64KB", "256MB" or
+// "1Gi". Units are case-insensitive and always binary (1KB = 1024 bytes).
+func parseSize(value string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(value))
+
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
+
+// parseRate parses a byte rate per second such as "10KBps", "1MB/s" or
+// "512", using the units of parseSize.
+func parseRate(value string) (int64, error) {
+	str := strings.TrimSpace(value)
+	for _, suffix := range []string{"ps", "PS", "/s", "/S"} {
+		str = strings.TrimSuffix(str, suffix)
+	}
+
+	rate, err := parseSize(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate '%s'", value)
+	}
+
+	return rate, nil
+}
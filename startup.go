@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"time"
+)
+
+// applyJitter returns base shifted by a random offset in [-jitter, +jitter],
+// never going below zero.
+func applyJitter(base, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return base
+	}
+
+	actual := base + time.Duration(rand.Int64N(2*int64(jitter)+1)) - jitter
+	if actual < 0 {
+		actual = 0
+	}
+	slog.Info(fmt.Sprintf("Applied jitter ±%s to startup delay: base %s, actual %s", jitter, base, actual),
+		"event", "startup_jitter", "base", base.String(), "jitter", jitter.String(), "actual", actual.String())
+
+	return actual
+}
+
+// runStartup waits out the startup delay while the server is already
+// listening, then marks the server as started. It gives up if ctx is done.
+func runStartup(ctx context.Context, s *ServerState, delay time.Duration) {
+	began := s.clock.Now()
+	if delay > 0 {
+		slog.Info(fmt.Sprintf("Waiting %s before marking the server as started...", delay), "event", "startup_wait", "delay", delay.String())
+		s.SetStartingUntil(s.clock.Now().Add(delay))
+		if err := sleepClock(ctx, s.clock, delay); err != nil {
+			slog.Info("Startup aborted before the delay elapsed.", "event", "startup_aborted")
+			return
+		}
+	}
+
+	completeStartup(s, began, "configured_delay", s.StartupDelay().String(), "delay", delay.String())
+}
+
+// runPhases steps through the named startup phases, spending d in each, and
+// marks the server as started after the last. It gives up if ctx is done.
+func runPhases(ctx context.Context, s *ServerState, phases []string, d time.Duration) {
+	began := s.clock.Now()
+	s.SetStartingUntil(began.Add(time.Duration(len(phases)) * d))
+
+	for i, name := range phases {
+		s.SetPhase(phases, i)
+		slog.Info(fmt.Sprintf("Startup phase %d/%d: %s (%s)", i+1, len(phases), name, d),
+			"event", "startup_phase", "phase", i+1, "phase_name", name, "phases", len(phases), "duration", d.String())
+		if err := sleepClock(ctx, s.clock, d); err != nil {
+			slog.Info(fmt.Sprintf("Startup aborted during phase %s.", name), "event", "startup_aborted", "phase_name", name)
+			return
+		}
+	}
+
+	completeStartup(s, began, "phases", len(phases), "phase_duration", d.String())
+}
+
+// completeStartup marks the server as started and logs how long startup took
+// since began, along with attrs describing what it waited for.
+func completeStartup(s *ServerState, began time.Time, attrs ...any) {
+	s.SetStarted(true)
+
+	now := s.clock.Now()
+	elapsed := now.Sub(began)
+	slog.Info(fmt.Sprintf("Startup complete after %s, /startup and /ready now return 200.", elapsed.Round(time.Millisecond)),
+		append([]any{"event", "startup_complete", "elapsed", elapsed.String(), "elapsed_seconds", elapsed.Seconds(),
+			"completed_at", now.UTC().Format(time.RFC3339Nano)}, attrs...)...)
+}
+
+// runReinit simulates a cold start of the running process: the server is
+// not started or ready until delay elapses. It gives up if ctx is done.
+func runReinit(ctx context.Context, s *ServerState, delay time.Duration) {
+	until := s.clock.Now().Add(delay)
+	s.BeginReinit(until)
+	logStateChange("/startup", "starting", fmt.Sprintf("Simulated re-init: /startup and /ready will fail for %s", delay))
+
+	if err := sleepClock(ctx, s.clock, delay); err != nil {
+		return
+	}
+	if s.FinishReinit(until) {
+		logStateChange("/startup", "started", fmt.Sprintf("Simulated re-init complete after %s, /startup and /ready now return 200", delay))
+	}
+}
+
+// startupFilePollInterval is how often runStartupFile checks for the file.
+const startupFilePollInterval = 500 * time.Millisecond
+
+// runStartupFile keeps the server in the starting state until path exists,
+// letting an external process decide when startup completes.
+func runStartupFile(ctx context.Context, s *ServerState, path string) {
+	began := s.clock.Now()
+	slog.Info(fmt.Sprintf("Waiting for startup file %s before marking the server as started...", path), "event", "startup_wait", "file", path)
+
+	ticker := time.NewTicker(startupFilePollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Startup aborted before the startup file appeared.", "event", "startup_aborted")
+			return
+		case <-ticker.C:
+		}
+	}
+
+	slog.Info(fmt.Sprintf("Startup file %s detected.", path), "event", "startup_file_detected", "file", path)
+	completeStartup(s, began, "file", path)
+}
+
+// startupDeadlinePollInterval is how often enforceStartupDeadline checks
+// whether startup has completed.
+const startupDeadlinePollInterval = 500 * time.Millisecond
+
+// enforceStartupDeadline exits the process with code 1 unless the server is
+// started and every readiness check passes within deadline, simulating a pod
+// that never comes up. It returns once both hold or ctx is done.
+func enforceStartupDeadline(ctx context.Context, s *ServerState, checks []checker, deadline time.Duration) {
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	ticker := time.NewTicker(startupDeadlinePollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.IsStarted() {
+			if _, err := runChecks(ctx, checks); err == nil {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			slog.Error(fmt.Sprintf("Startup did not complete within the %s deadline, exiting.", deadline),
+				"event", "startup_deadline_exceeded", "deadline", deadline.String(), "started", s.IsStarted())
+			os.Exit(1)
+		case <-ticker.C:
+		}
+	}
+}
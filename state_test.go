@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A startup that completes during a simulated re-init must not leave /ready
+// failing once the re-init ends.
+func TestFinishReinitAfterStartupCompleted(t *testing.T) {
+	s := NewServerState()
+	s.SetStartingUntil(time.Now().Add(time.Second))
+
+	until := time.Now().Add(time.Minute)
+	s.BeginReinit(until)
+	s.SetStarted(true)
+
+	if !s.FinishReinit(until) {
+		t.Fatal("FinishReinit() = false for the pending re-init")
+	}
+	if !s.IsStarted() || !s.IsReady() {
+		t.Errorf("started %t, ready %t after the re-init, want both true", s.IsStarted(), s.IsReady())
+	}
+}
+
+func TestFinishReinitReplaced(t *testing.T) {
+	s := NewServerState()
+	first := time.Now().Add(time.Minute)
+	s.BeginReinit(first)
+	s.BeginReinit(first.Add(time.Minute))
+
+	if s.FinishReinit(first) {
+		t.Error("FinishReinit() = true for a re-init that was replaced")
+	}
+	if s.IsReady() {
+		t.Error("IsReady() = true while the later re-init is pending")
+	}
+}
+
+func TestHealthCodeClearsRedirect(t *testing.T) {
+	for name, set := range map[string]func(*ServerState){
+		"SetHealthCode":   func(s *ServerState) { s.SetHealthCode(503) },
+		"SetUnhealthyFor": func(s *ServerState) { s.SetUnhealthyFor(time.Minute, 503) },
+	} {
+		s := NewServerState()
+		s.SetHealthRedirect("http://example.com/")
+		set(s)
+
+		if got := s.HealthRedirect(); got != "" {
+			t.Errorf("%s left HealthRedirect() = %q, want none", name, got)
+		}
+	}
+}
+
+// A health code set after a sequence wins, even one below 400 that would
+// otherwise fall through to the sequence.
+func TestHealthCodeOverridesSequence(t *testing.T) {
+	for name, set := range map[string]func(*ServerState){
+		"SetHealthCode":   func(s *ServerState) { s.SetHealthCode(http.StatusNoContent) },
+		"SetUnhealthyFor": func(s *ServerState) { s.SetUnhealthyFor(time.Minute, http.StatusNoContent) },
+	} {
+		s := NewServerState()
+		s.SetHealthSequence([]int{http.StatusServiceUnavailable})
+		set(s)
+
+		rec := httptest.NewRecorder()
+		healthHandler(s, nil, false).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthy", nil))
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("/healthy after %s = %d, want %d", name, rec.Code, http.StatusNoContent)
+		}
+	}
+}
+
+func TestSnapshotIncludesInjectedFaults(t *testing.T) {
+	s := NewServerState()
+	s.SetRole("replica")
+	s.SetHealthRedirect("http://example.com/")
+	s.SetHealthSequence([]int{200, 503})
+	s.SetEndpointEnabled("/ready", false)
+	s.SetExitCode(3)
+
+	data, err := json.Marshal(s.Snapshot())
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+
+	for key, want := range map[string]string{
+		"role":               `"replica"`,
+		"health_redirect":    `"http://example.com/"`,
+		"health_sequence":    `[200,503]`,
+		"disabled_endpoints": `["/ready"]`,
+		"exit_code":          `3`,
+	} {
+		value, _ := json.Marshal(got[key])
+		if string(value) != want {
+			t.Errorf("snapshot %s = %s, want %s", key, value, want)
+		}
+	}
+}
+
+// The JSON body must agree with the status code, including codes that come
+// from a sequence or an injected failure rather than the health state.
+func TestHealthJSONMatchesCode(t *testing.T) {
+	s := NewServerState()
+	s.SetHealthSequence([]int{http.StatusServiceUnavailable})
+
+	req := httptest.NewRequest(http.MethodGet, "/healthy", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	healthHandler(s, nil, false).ServeHTTP(rec, req)
+
+	var resp probeResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || resp.Healthy {
+		t.Errorf("/healthy = %d with healthy %t, want 503 with healthy false", rec.Code, resp.Healthy)
+	}
+}
+
+func TestUnhealthyThreshold(t *testing.T) {
+	s := NewServerState()
+	s.SetStarted(true)
+	s.SetUnhealthyThreshold(2)
+	ready := readyHandler(s, nil, false, false)
+	probe := func() {
+		ready.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ready", nil))
+	}
+
+	s.SetReady(false)
+	probe()
+	s.SetReady(true)
+	s.SetReady(false)
+	probe()
+	if !s.IsHealthy() {
+		t.Fatal("IsHealthy() = false although going ready reset the failure count")
+	}
+
+	probe()
+	if s.IsHealthy() {
+		t.Fatal("IsHealthy() = true after reaching the threshold")
+	}
+
+	// Health restored by hand while /ready keeps failing must not be left
+	// alone just because the count has passed the threshold.
+	s.SetHealth(true)
+	probe()
+	if s.IsHealthy() {
+		t.Error("IsHealthy() = true after another failure past the threshold")
+	}
+
+	s.Reset()
+	if got := s.Snapshot().ReadyFailures; got != 0 {
+		t.Errorf("ReadyFailures after Reset() = %d, want 0", got)
+	}
+}
+
+func TestHealthRejectsPeerOutsideCIDR(t *testing.T) {
+	var allowed cidrList
+	if err := allowed.Set("10.0.0.0/8"); err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	s := NewServerState()
+	health := healthHandler(s, allowed, false)
+
+	req := httptest.NewRequest(http.MethodGet, "/healthy", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	health.ServeHTTP(rec, req)
+
+	var resp probeResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || resp.Status != "unhealthy" {
+		t.Errorf("/healthy from outside = %d %q, want 503 unhealthy", rec.Code, resp.Status)
+	}
+	if got := s.healthHits.Load(); got != 1 {
+		t.Errorf("health hits = %d, want the rejected request counted", got)
+	}
+
+	req.RemoteAddr = "10.1.2.3:1234"
+	rec = httptest.NewRecorder()
+	health.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("/healthy from inside = %d, want 200", rec.Code)
+	}
+
+	s.SetEndpointEnabled("/healthy", false)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec = httptest.NewRecorder()
+	health.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("disabled /healthy from outside = %d, want 404", rec.Code)
+	}
+}
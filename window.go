@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateWindowSeconds is the span over which rateWindow averages requests.
+const rateWindowSeconds = 10
+
+// rateWindow counts events in one-second buckets over the last
+// rateWindowSeconds so a recent rate can be reported cheaply.
+type rateWindow struct {
+	mu      sync.Mutex
+	buckets [rateWindowSeconds]struct {
+		second int64
+		count  int64
+	}
+}
+
+// Add records one event at now.
+func (w *rateWindow) Add(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	second := now.Unix()
+	b := &w.buckets[second%rateWindowSeconds]
+	if b.second != second {
+		b.second = second
+		b.count = 0
+	}
+	b.count++
+}
+
+// Rate returns the average events per second over the window ending at now.
+func (w *rateWindow) Rate(now time.Time) float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	second := now.Unix()
+	var total int64
+	for _, b := range w.buckets {
+		if second-b.second < rateWindowSeconds {
+			total += b.count
+		}
+	}
+
+	return float64(total) / rateWindowSeconds
+}